@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+//CachedProvider - DNSProvider that answers reads from a snapshot of every record, so syncing
+//records that haven't changed doesn't call the API. The snapshot is refreshed lazily: the first
+//read after it is older than RefreshInterval lists every record again. It is updated with the
+//records this controller writes. A failed write drops the snapshot since the records may have
+//changed underneath it, and a write of a record that no longer exists is retried so the next
+//sync works from the fresh records.
+type CachedProvider struct {
+	Provider        DNSProvider
+	RefreshInterval time.Duration
+	records         []DNSRecord
+	refreshed       time.Time
+	mux             sync.Mutex
+}
+
+var _ DNSProvider = &CachedProvider{}
+var _ BatchProvider = &CachedProvider{}
+
+func NewCachedProvider(provider DNSProvider, refreshInterval time.Duration) *CachedProvider {
+	return &CachedProvider{
+		Provider:        provider,
+		RefreshInterval: refreshInterval,
+	}
+}
+
+//snapshotLocked - The records, listing them again if the snapshot is missing or too old
+func (p *CachedProvider) snapshotLocked() ([]DNSRecord, error) {
+	if p.records != nil && time.Since(p.refreshed) < p.RefreshInterval {
+		return p.records, nil
+	}
+	records, err := p.Provider.ListRecords(RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("Refreshed the record snapshot, %d records", len(records))
+	p.records = records
+	p.refreshed = time.Now()
+	return p.records, nil
+}
+
+//Invalidate - Drop the snapshot so the next read lists the records again
+func (p *CachedProvider) Invalidate() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.records = nil
+}
+
+func (p *CachedProvider) ManagesName(name string) error {
+	return p.Provider.ManagesName(name)
+}
+
+func (p *CachedProvider) Capabilities() ProviderCapabilities {
+	return p.Provider.Capabilities()
+}
+
+//ListRecords - The records of the snapshot matching the filter
+func (p *CachedProvider) ListRecords(filter RecordFilter) ([]DNSRecord, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	records, err := p.snapshotLocked()
+	if err != nil {
+		return nil, err
+	}
+	matches := []DNSRecord{}
+	for _, record := range records {
+		if filter.Matches(record) {
+			matches = append(matches, record)
+		}
+	}
+	return matches, nil
+}
+
+//GetRecord - The first record of the snapshot with the type and name
+func (p *CachedProvider) GetRecord(recordType, name string) (DNSRecord, error) {
+	records, err := p.ListRecords(RecordFilter{RecordType: recordType, Name: name})
+	if err != nil || len(records) == 0 {
+		return DNSRecord{}, err
+	}
+	return records[0], nil
+}
+
+func (p *CachedProvider) CreateRecord(record DNSRecord) (DNSRecord, error) {
+	created, err := p.Provider.CreateRecord(record)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if err != nil {
+		p.records = nil
+		return created, err
+	}
+	if p.records != nil {
+		p.records = append(p.records, created)
+	}
+	return created, nil
+}
+
+func (p *CachedProvider) UpdateRecord(record DNSRecord) (DNSRecord, error) {
+	updated, err := p.Provider.UpdateRecord(record)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if err != nil {
+		p.records = nil
+		return updated, retryIfNotFound(err)
+	}
+	for i := range p.records {
+		if p.records[i].ID == updated.ID {
+			p.records[i] = updated
+		}
+	}
+	return updated, nil
+}
+
+func (p *CachedProvider) DeleteRecord(record DNSRecord) error {
+	err := p.Provider.DeleteRecord(record)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if err != nil {
+		p.records = nil
+		return retryIfNotFound(err)
+	}
+	for i := range p.records {
+		if p.records[i].ID == record.ID {
+			p.records = append(p.records[:i], p.records[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+//retryIfNotFound - A record the snapshot had but the provider doesn't was changed outside the
+//controller, so the write is retried with the snapshot listed again instead of given up on
+func retryIfNotFound(err error) error {
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return &RetryableError{Err: notFound}
+	}
+	return err
+}
+
+//ApplyBatch - Apply the plan with the wrapped provider and drop the snapshot, since the IDs of
+//the created records aren't known
+func (p *CachedProvider) ApplyBatch(plan Plan) error {
+	batch, ok := p.Provider.(BatchProvider)
+	if !ok {
+		return ErrBatchUnsupported
+	}
+	err := batch.ApplyBatch(plan)
+	if err != ErrBatchUnsupported {
+		p.Invalidate()
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+)
+
+func TestCachedProviderOnlyWritesChanges(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	cached := NewCachedProvider(cf, time.Hour)
+	controller, _ := newTestController(cached, "1.2.3.4")
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+	server.ResetRequests()
+
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	want := []string{
+		"GET /zones/zone1/dns_records",
+		"POST /zones/zone1/dns_records",
+		"POST /zones/zone1/dns_records",
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests of the first sync = %v, want %v", got, want)
+	}
+
+	//Nothing changed, so nothing is requested
+	server.ResetRequests()
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if got := server.Requests(); len(got) != 0 {
+		t.Errorf("requests of an unchanged sync = %v", got)
+	}
+
+	controller.currentIP.Set("5.6.7.8")
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if got := server.Requests(); len(got) != 1 || got[0][:3] != "PUT" {
+		t.Errorf("requests after an IP change = %v", got)
+	}
+
+	//A failed write drops the snapshot so the records are listed again
+	server.ResetRequests()
+	server.FailNext(http.StatusNotFound, 81044, "Record does not exist")
+	controller.currentIP.Set("9.9.9.9")
+	if err := controller.cloudflareSync("service/default/web"); err == nil {
+		t.Error("cloudflareSync() succeeded while the update failed")
+	}
+	want = []string{
+		"PUT /zones/zone1/dns_records/record2",
+		"GET /zones/zone1/dns_records",
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests of a failed sync = %v, want %v", got, want)
+	}
+	wantRecords := []string{
+		"A web.example.com 5.6.7.8",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, wantRecords) {
+		t.Errorf("records = %v, want %v", got, wantRecords)
+	}
+}
+
+func TestCachedProviderRefreshes(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	cached := NewCachedProvider(provider, 10*time.Millisecond)
+	if record, _ := cached.GetRecord("A", "web.example.com"); record.ID != "" {
+		t.Fatalf("GetRecord() = %+v before the record exists", record)
+	}
+
+	//Records written by someone else show up once the snapshot is refreshed
+	provider.CreateRecord(DNSRecord{RecordType: "A", Name: "web.example.com", Content: "1.2.3.4"})
+	if record, _ := cached.GetRecord("A", "web.example.com"); record.ID != "" {
+		t.Errorf("GetRecord() = %+v from a fresh snapshot", record)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if record, _ := cached.GetRecord("A", "WEB.example.com"); record.Content != "1.2.3.4" {
+		t.Errorf("GetRecord() = %+v after a refresh", record)
+	}
+}
+
+func TestCachedProviderRetriesStaleWrites(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	cached := NewCachedProvider(provider, time.Hour)
+	controller, _ := newTestController(cached, "1.2.3.4")
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+
+	//The A record is deleted behind the snapshot, so the update fails but is retried
+	record, _ := provider.GetRecord("A", "web.example.com")
+	provider.DeleteRecord(record)
+	controller.currentIP.Set("5.6.7.8")
+	err := controller.cloudflareSync("service/default/web")
+	if err == nil || isPermanent(err) {
+		t.Fatalf("cloudflareSync() of a stale record error = %v, want a retryable error", err)
+	}
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() retry error = %v", err)
+	}
+	if record, _ := provider.GetRecord("A", "web.example.com"); record.Content != "5.6.7.8" {
+		t.Errorf("A record after the retry = %+v", record)
+	}
+}
@@ -4,19 +4,62 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+//Cloudflare - Client for the Cloudflare v4 API. If APIToken is set it is used as
+//a scoped Bearer token, otherwise AuthEmail and AuthToken (the Global API Key) are used.
+//ZoneNames holds the configured zone IDs or names, when it is empty every zone the
+//credentials can access is managed. Zones is filled in by LoadZones.
+//BaseURL and HTTPClient can be replaced to talk to a mock or through a proxy.
+//Requests wait for the Limiter, if it is set, to stay under the API rate limit.
 type Cloudflare struct {
-	AuthEmail string
-	AuthToken string
-	ZoneID    string
-	mux       sync.Mutex
+	AuthEmail  string
+	AuthToken  string
+	APIToken   string
+	ZoneNames  []string
+	Zones      []CloudflareZone
+	PerPage    int
+	BaseURL    string
+	HTTPClient *http.Client
+	Limiter    *RateLimiter
+	mux        sync.Mutex
 }
 
+var _ DNSProvider = &Cloudflare{}
+var _ BatchProvider = &Cloudflare{}
+
+//ZoneNotManagedError - Returned when a hostname does not belong to any managed zone
+type ZoneNotManagedError struct {
+	Name string
+}
+
+func (e *ZoneNotManagedError) Error() string {
+	return "hostname " + e.Name + " does not belong to any managed zone"
+}
+
+const (
+	//defaultPerPage - Page size used when listing records if PerPage is not set
+	defaultPerPage = 100
+	//DefaultCloudflareBaseURL - Cloudflare v4 API endpoint
+	DefaultCloudflareBaseURL = "https://api.cloudflare.com/client/v4"
+	//DefaultCloudflareTimeout - Timeout for a single API request
+	DefaultCloudflareTimeout = 30 * time.Second
+	//DefaultCloudflareRateLimit - Requests per 5 minutes, below the API limit of 1200 to leave
+	//room for the dashboard and other clients of the same user
+	DefaultCloudflareRateLimit = 1000
+	//defaultRetryAfter - How long to hold requests after a 429 without a Retry-After header
+	defaultRetryAfter = time.Minute
+)
+
 type CloudflareRecordReq struct {
 	RecordType string `json:"type"`
 	Name       string `json:"name"`
@@ -47,6 +90,30 @@ type CloudflareRespError struct {
 	Message string `json:"message"`
 }
 
+type CloudflareZone struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type CloudflareZonesResp struct {
+	Success    bool                     `json:"success"`
+	Result     []CloudflareZone         `json:"result"`
+	ResultInfo CloudflareRespResultInfo `json:"result_info"`
+	Errors     []CloudflareRespError    `json:"errors"`
+}
+
+type CloudflareTokenStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type CloudflareTokenVerifyResp struct {
+	Success bool                  `json:"success"`
+	Result  CloudflareTokenStatus `json:"result"`
+	Errors  []CloudflareRespError `json:"errors"`
+}
+
 type CloudflareResp struct {
 	Success    bool                     `json:"success"`
 	Result     []CloudflareRecord       `json:"result"`
@@ -61,272 +128,514 @@ type CloudflareSingleResp struct {
 	Errors     []CloudflareRespError    `json:"errors"`
 }
 
-func NewCloudflare(authEmail, authToken, zoneID string) Cloudflare {
-	return Cloudflare{
-		AuthEmail: authEmail,
-		AuthToken: authToken,
-		ZoneID:    zoneID,
-	}
-}
-
-func (c *Cloudflare) CallAPI(method, path string, body io.Reader) error {
-	// c.mux.Lock()
-	// api_url := "https://api.cloudflare.com/client/v4/zones/" + c.ZoneID + "/dns_records/" + id
-	// client := &http.Client{}
-	// req, err := http.NewRequest("PATCH", api_url, body)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// req.Header.Add("X-Auth-Email", c.AuthEmail)
-	// req.Header.Add("X-Auth-Key", c.AuthToken)
-	// req.Header.Add("Content-type", "application/json")
-	// c.mux.Unlock()
-
-	// resp, err := client.Do(req)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// defer resp.Body.Close() //Close the resp body when finished
-
-	// r := Cf_data{}
-	// json.NewDecoder(resp.Body).Decode(&r)
-
-	// //Check if success, print errors from api if not.
-	// if !r.Success {
-	// 	for _, e := range r.Errors {
-	// 		log.Printf("Error code %d: %s\n", e.Code, e.Message)
-	// 	}
-	// 	return fmt.Errorf("Api call failed")
-	// }
-
-	// /*
-	// 	Marked to be deleted after testing.
-	// 	resp_data, err := ioutil.ReadAll(resp.Body)
-	// 	if err != nil {
-	// 		log.Fatal(err)
-	// 	}
-	// */
+type CloudflareBatchDelete struct {
+	ID string `json:"id"`
+}
 
-	return nil
+//CloudflareBatchReq - Changes applied in one transaction, in the order deletes, puts, posts
+type CloudflareBatchReq struct {
+	Deletes []CloudflareBatchDelete `json:"deletes,omitempty"`
+	Puts    []CloudflareRecord      `json:"puts,omitempty"`
+	Posts   []CloudflareRecordReq   `json:"posts,omitempty"`
 }
 
-//ListTXTRecords - List all TXT records
-func (c *Cloudflare) ListTXTRecords() (records []CloudflareRecord, err error) {
-	c.mux.Lock()
-	url := "https://api.cloudflare.com/client/v4/zones/" + c.ZoneID + "/dns_records?type=TXT"
-	//fmt.Println(url)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return []CloudflareRecord{}, err
+type CloudflareBatchResp struct {
+	Success bool                  `json:"success"`
+	Errors  []CloudflareRespError `json:"errors"`
+}
+
+//CloudflareAPIError - The errors of a response that wasn't successful
+type CloudflareAPIError struct {
+	Errors []CloudflareRespError
+}
+
+func (e *CloudflareAPIError) Error() string {
+	var errMessage string
+	for _, respError := range e.Errors {
+		errMessage += "Error code " + strconv.Itoa(respError.Code) + ", " + respError.Message + "."
+	}
+	if errMessage == "" {
+		errMessage = "Cloudflare API call failed without an error message."
+	}
+	return errMessage
+}
+
+//HasCode - Check if one of the errors has the code
+func (e *CloudflareAPIError) HasCode(code int) bool {
+	for _, respError := range e.Errors {
+		if respError.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func NewCloudflare(authEmail, authToken, apiToken string, zoneNames []string, perPage int) *Cloudflare {
+	return &Cloudflare{
+		AuthEmail:  authEmail,
+		AuthToken:  authToken,
+		APIToken:   apiToken,
+		ZoneNames:  zoneNames,
+		PerPage:    perPage,
+		BaseURL:    DefaultCloudflareBaseURL,
+		HTTPClient: &http.Client{Timeout: DefaultCloudflareTimeout},
+		Limiter:    NewRateLimiter(DefaultCloudflareRateLimit, 5*time.Minute),
+	}
+}
+
+//retryAfter - Parse the Retry-After header, which is either seconds or an HTTP date
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return defaultRetryAfter
+}
+
+//addAuthHeaders - Add the API token or the email/global key headers to a request
+func (c *Cloudflare) addAuthHeaders(req *http.Request) {
+	if c.APIToken != "" {
+		req.Header.Add("Authorization", "Bearer "+c.APIToken)
+		return
 	}
 	req.Header.Add("X-Auth-Email", c.AuthEmail)
 	req.Header.Add("X-Auth-Key", c.AuthToken)
-	req.Header.Add("Content-type", "application/json")
-	c.mux.Unlock()
+}
 
-	resp, err := client.Do(req)
+//cloudflareError - Build a single error from the errors returned by the API
+func cloudflareError(respErrors []CloudflareRespError) error {
+	return &CloudflareAPIError{Errors: respErrors}
+}
+
+//Verify - Check the API token is valid and active. Zone permissions are checked by LoadZones.
+func (c *Cloudflare) Verify() error {
+	if c.APIToken == "" {
+		return nil
+	}
+
+	tokenResp := CloudflareTokenVerifyResp{}
+	err := c.CallAPI("GET", "/user/tokens/verify", nil, &tokenResp)
+	if err != nil && isPermanent(err) {
+		return fmt.Errorf("Cloudflare API token is not valid: %v", err)
+	}
 	if err != nil {
-		return []CloudflareRecord{}, err
+		return err
+	}
+	if !tokenResp.Success {
+		return fmt.Errorf("Cloudflare API token is not valid: %v", cloudflareError(tokenResp.Errors))
+	}
+	if tokenResp.Result.Status != "active" {
+		return fmt.Errorf("Cloudflare API token is %v, expected active", tokenResp.Result.Status)
 	}
-	defer resp.Body.Close() //Close the resp body when finished
 
-	respBody := CloudflareResp{}
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	return nil
+}
+
+//LoadZones - Resolve the configured zone IDs or names against the zones the credentials
+//can access, and check each managed zone allows editing DNS records.
+func (c *Cloudflare) LoadZones() error {
+	available, err := c.listZones()
 	if err != nil {
-		return []CloudflareRecord{}, err
+		return err
 	}
 
-	// //Check if success, print errors from api if not.
-	// if !respBody.Success {
-	// 	// for _, e := range respBody.Errors {
-	// 	// 	log.Printf("Error code %d: %s\n", e.Code, e.Message)
-	// 	// }
-	// 	return fmt.Errorf("Api call failed")
-	// }
+	//Discovered zones we can't edit are skipped rather than failing startup
+	zones := []CloudflareZone{}
+	if len(c.ZoneNames) == 0 {
+		for _, zone := range available {
+			if hasDNSEditPermission(zone) {
+				zones = append(zones, zone)
+			}
+		}
+	}
+	for _, zoneName := range c.ZoneNames {
+		found := false
+		for _, zone := range available {
+			if zone.ID == zoneName || strings.EqualFold(zone.Name, zoneName) {
+				zones = append(zones, zone)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Cloudflare zone %v not found or not accessible with the configured credentials", zoneName)
+		}
+	}
+	if len(zones) == 0 {
+		return errors.New("Cloudflare credentials cannot access any zones")
+	}
 
-	if len(respBody.Result) == 0 {
-		return []CloudflareRecord{}, errors.New("Could not find any TXT records")
+	for _, zone := range zones {
+		if !hasDNSEditPermission(zone) {
+			return fmt.Errorf("Cloudflare credentials are missing Zone.DNS:Edit permission on zone %v (%v)", zone.Name, zone.ID)
+		}
 	}
 
-	return respBody.Result, nil
+	//Longest names first so the most specific zone wins when matching hostnames
+	sort.Slice(zones, func(i, j int) bool {
+		return len(zones[i].Name) > len(zones[j].Name)
+	})
+
+	c.mux.Lock()
+	c.Zones = zones
+	c.mux.Unlock()
+
+	return nil
 }
 
-//GetRecord - Get A record info
-func (c *Cloudflare) GetRecord(recordType, recordName string) (record CloudflareRecord, err error) {
+//hasDNSEditPermission - The zone only reports permissions for the credentials when they
+//are known, so a missing list is not treated as a failure.
+func hasDNSEditPermission(zone CloudflareZone) bool {
+	if len(zone.Permissions) == 0 {
+		return true
+	}
+	for _, permission := range zone.Permissions {
+		if permission == "#dns_records:edit" {
+			return true
+		}
+	}
+	return false
+}
+
+//listZones - List every zone the credentials can access
+func (c *Cloudflare) listZones() (zones []CloudflareZone, err error) {
+	zones = []CloudflareZone{}
+	for page := 1; ; page++ {
+		respBody := CloudflareZonesResp{}
+		err = c.CallAPI("GET", "/zones?page="+strconv.Itoa(page)+"&per_page=50", nil, &respBody)
+		if err != nil {
+			return []CloudflareZone{}, err
+		}
+
+		//Check if success, print errors from api if not.
+		if !respBody.Success {
+			return []CloudflareZone{}, cloudflareError(respBody.Errors)
+		}
+
+		zones = append(zones, respBody.Result...)
+		if page >= respBody.ResultInfo.TotalPages || len(respBody.Result) == 0 {
+			break
+		}
+	}
+
+	return zones, nil
+}
+
+//ZoneForName - Find the managed zone with the longest name matching the hostname
+func (c *Cloudflare) ZoneForName(name string) (zone CloudflareZone, err error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, zone := range c.Zones {
+		zoneName := strings.ToLower(zone.Name)
+		if name == zoneName || strings.HasSuffix(name, "."+zoneName) {
+			return zone, nil
+		}
+	}
+
+	return CloudflareZone{}, &ZoneNotManagedError{Name: name}
+}
+
+//CallAPI - Make an authenticated request to the API path and decode the response into v
+func (c *Cloudflare) CallAPI(method, path string, body io.Reader, v interface{}) error {
 	c.mux.Lock()
-	url := "https://api.cloudflare.com/client/v4/zones/" + c.ZoneID + "/dns_records?type=" + recordType + "&name=" + recordName
-	//fmt.Println(url)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultCloudflareBaseURL
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(baseURL, "/")+path, body)
 	if err != nil {
-		return CloudflareRecord{}, err
+		c.mux.Unlock()
+		return err
 	}
-	req.Header.Add("X-Auth-Email", c.AuthEmail)
-	req.Header.Add("X-Auth-Key", c.AuthToken)
+	c.addAuthHeaders(req)
 	req.Header.Add("Content-type", "application/json")
+	limiter := c.Limiter
 	c.mux.Unlock()
 
+	if limiter != nil {
+		limiter.Wait()
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return CloudflareRecord{}, err
+		return &RetryableError{Err: err}
 	}
 	defer resp.Body.Close() //Close the resp body when finished
 
+	if resp.StatusCode < 400 {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	//Rate limits and server errors are worth retrying, other errors mean the request was rejected
 	respBody := CloudflareResp{}
 	err = json.NewDecoder(resp.Body).Decode(&respBody)
-	if err != nil {
-		return CloudflareRecord{}, err
+	if err != nil || len(respBody.Errors) == 0 {
+		err = fmt.Errorf("Cloudflare API call failed with status %v", resp.Status)
+	} else {
+		err = cloudflareError(respBody.Errors)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := retryAfter(resp.Header.Get("Retry-After"))
+		if limiter != nil {
+			limiter.Pause(wait)
+		}
+		return &RetryableError{Err: fmt.Errorf("%v Retry after %v", err, wait)}
+	}
+	if resp.StatusCode >= 500 {
+		return &RetryableError{Err: err}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return &PermanentError{Err: &NotFoundError{Err: err}}
+	}
+	return &PermanentError{Err: err}
+}
+
+//query - Build the dns_records query string for a page of results
+func (f RecordFilter) query(page, perPage int) string {
+	values := url.Values{}
+	if f.RecordType != "" {
+		values.Set("type", f.RecordType)
+	}
+	if f.Name != "" {
+		values.Set("name", f.Name)
 	}
+	if f.Content != "" {
+		values.Set("content", f.Content)
+	}
+	values.Set("page", strconv.Itoa(page))
+	values.Set("per_page", strconv.Itoa(perPage))
+	return values.Encode()
+}
 
-	// //Check if success, print errors from api if not.
-	// if !respBody.Success {
-	// 	// for _, e := range respBody.Errors {
-	// 	// 	log.Printf("Error code %d: %s\n", e.Code, e.Message)
-	// 	// }
-	// 	return fmt.Errorf("Api call failed")
-	// }
+//ManagesName - Check the name belongs to one of the managed zones
+func (c *Cloudflare) ManagesName(name string) error {
+	_, err := c.ZoneForName(name)
+	return err
+}
+
+//Capabilities - Cloudflare can proxy traffic to the records it serves
+func (c *Cloudflare) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{SupportsProxying: true}
+}
 
-	if len(respBody.Result) == 0 {
-		//return CloudflareRecord{}, errors.New("Could not find any records for " + recordName)
-		return CloudflareRecord{}, nil
+//ListRecords - List all records matching the filter, walking every page of results
+func (c *Cloudflare) ListRecords(filter RecordFilter) (records []DNSRecord, err error) {
+	perPage := c.PerPage
+	if perPage <= 0 {
+		perPage = defaultPerPage
 	}
 
-	return respBody.Result[0], nil
+	//A name can only live in one zone, otherwise every managed zone is listed
+	var zones []CloudflareZone
+	if filter.Name != "" {
+		zone, err := c.ZoneForName(filter.Name)
+		if err != nil {
+			return []DNSRecord{}, err
+		}
+		zones = []CloudflareZone{zone}
+	} else {
+		c.mux.Lock()
+		zones = c.Zones
+		c.mux.Unlock()
+	}
+
+	records = []DNSRecord{}
+	for _, zone := range zones {
+		zoneRecords, err := c.listZoneRecords(zone, filter, perPage)
+		if err != nil {
+			return []DNSRecord{}, err
+		}
+		for _, record := range zoneRecords {
+			records = append(records, DNSRecord(record))
+		}
+	}
+
+	return records, nil
+}
+
+//listZoneRecords - List the records in a single zone matching the filter
+func (c *Cloudflare) listZoneRecords(zone CloudflareZone, filter RecordFilter, perPage int) (records []CloudflareRecord, err error) {
+	records = []CloudflareRecord{}
+	for page := 1; ; page++ {
+		respBody := CloudflareResp{}
+		err = c.CallAPI("GET", "/zones/"+zone.ID+"/dns_records?"+filter.query(page, perPage), nil, &respBody)
+		if err != nil {
+			return []CloudflareRecord{}, err
+		}
+
+		//Check if success, print errors from api if not.
+		if !respBody.Success {
+			return []CloudflareRecord{}, cloudflareError(respBody.Errors)
+		}
+
+		records = append(records, respBody.Result...)
+		if page >= respBody.ResultInfo.TotalPages || len(respBody.Result) == 0 {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+//GetRecord - Get A record info
+func (c *Cloudflare) GetRecord(recordType, recordName string) (record DNSRecord, err error) {
+	records, err := c.ListRecords(RecordFilter{RecordType: recordType, Name: recordName})
+	if err != nil {
+		return DNSRecord{}, err
+	}
+
+	if len(records) == 0 {
+		return DNSRecord{}, nil
+	}
+
+	return records[0], nil
 }
 
 //CreateRecord - Create an record
-func (c *Cloudflare) CreateRecord(contentType, name, content string, ttl int, proxied bool) (record CloudflareRecord, err error) {
+func (c *Cloudflare) CreateRecord(record DNSRecord) (DNSRecord, error) {
 	newRecord := CloudflareRecordReq{
-		RecordType: contentType,
-		Name:       name,
-		Content:    content,
-		TTL:        ttl,
-		Proxied:    proxied,
+		RecordType: record.RecordType,
+		Name:       record.Name,
+		Content:    record.Content,
+		TTL:        record.TTL,
+		Proxied:    record.Proxied,
 	}
 	body := new(bytes.Buffer)
 	json.NewEncoder(body).Encode(newRecord)
 
-	c.mux.Lock()
-	url := "https://api.cloudflare.com/client/v4/zones/" + c.ZoneID + "/dns_records"
-	//fmt.Println(url)
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, body)
+	zone, err := c.ZoneForName(record.Name)
 	if err != nil {
-		return CloudflareRecord{}, err
+		return DNSRecord{}, err
 	}
-	req.Header.Add("X-Auth-Email", c.AuthEmail)
-	req.Header.Add("X-Auth-Key", c.AuthToken)
-	req.Header.Add("Content-type", "application/json")
-	c.mux.Unlock()
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return CloudflareRecord{}, err
-	}
-	defer resp.Body.Close() //Close the resp body when finished
 
 	respBody := CloudflareSingleResp{}
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	err = c.CallAPI("POST", "/zones/"+zone.ID+"/dns_records", body, &respBody)
 	if err != nil {
-		return CloudflareRecord{}, err
+		return DNSRecord{}, err
 	}
 
 	//Check if success, print errors from api if not.
-	var errMessage string
 	if !respBody.Success {
-		for _, e := range respBody.Errors {
-			code := strconv.Itoa(e.Code)
-			errMessage += "Error code " + code + ", " + e.Message + "."
-		}
-		return CloudflareRecord{}, errors.New(errMessage)
+		return DNSRecord{}, cloudflareError(respBody.Errors)
 	}
 
-	return respBody.Result, nil
+	return DNSRecord(respBody.Result), nil
 }
 
-//UpdateRecordByID - Update record info
-func (c *Cloudflare) UpdateRecordByID(id, recordType, name, content string, ttl int, proxied bool) (record CloudflareRecord, err error) {
+//UpdateRecord - Update record info, the record is replaced by ID
+func (c *Cloudflare) UpdateRecord(record DNSRecord) (DNSRecord, error) {
 	newRecord := CloudflareRecordReq{
-		RecordType: recordType,
-		Name:       name,
-		Content:    content,
-		TTL:        ttl,
-		Proxied:    proxied,
+		RecordType: record.RecordType,
+		Name:       record.Name,
+		Content:    record.Content,
+		TTL:        record.TTL,
+		Proxied:    record.Proxied,
 	}
 	body := new(bytes.Buffer)
 	json.NewEncoder(body).Encode(newRecord)
 
-	c.mux.Lock()
-	url := "https://api.cloudflare.com/client/v4/zones/" + c.ZoneID + "/dns_records/" + id
-	//fmt.Println(url)
-	client := &http.Client{}
-	req, err := http.NewRequest("PUT", url, body)
-	if err != nil {
-		return CloudflareRecord{}, err
-	}
-	req.Header.Add("X-Auth-Email", c.AuthEmail)
-	req.Header.Add("X-Auth-Key", c.AuthToken)
-	req.Header.Add("Content-type", "application/json")
-	c.mux.Unlock()
-
-	resp, err := client.Do(req)
+	zone, err := c.ZoneForName(record.Name)
 	if err != nil {
-		return CloudflareRecord{}, err
+		return DNSRecord{}, err
 	}
-	defer resp.Body.Close() //Close the resp body when finished
 
 	respBody := CloudflareSingleResp{}
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	err = c.CallAPI("PUT", "/zones/"+zone.ID+"/dns_records/"+record.ID, body, &respBody)
 	if err != nil {
-		return CloudflareRecord{}, err
+		return DNSRecord{}, err
 	}
 
 	//Check if success, print errors from api if not.
-	var errMessage string
 	if !respBody.Success {
-		for _, e := range respBody.Errors {
-			code := strconv.Itoa(e.Code)
-			errMessage += "Error code " + code + ", " + e.Message + "."
-		}
-		return CloudflareRecord{}, errors.New(errMessage)
+		return DNSRecord{}, cloudflareError(respBody.Errors)
 	}
 
-	return respBody.Result, nil
+	return DNSRecord(respBody.Result), nil
 }
 
-func (c *Cloudflare) SyncRecord(contentType, name, content string, ttl int, proxied bool) error {
-	record, err := c.GetRecord(contentType, name)
-	if err != nil {
-		//fmt.Printf("Failed trying to get TXT record for %v: %v\n", key, err)
-		//errors.New("Failed trying to get TXT record for " + name + ": " + err)
-		return err
+//ApplyBatch - Apply the plan with one batch request per zone. Each batch is a transaction, so
+//a zone either gets every change or none of them. When a batch fails after the batches of
+//other zones were applied, the error is a *BatchError that splits the plan by zone.
+func (c *Cloudflare) ApplyBatch(plan Plan) error {
+	batches := map[string]*CloudflareBatchReq{}
+	plans := map[string]*Plan{}
+	zoneIDs := []string{}
+	batchFor := func(name string) (*CloudflareBatchReq, *Plan, error) {
+		zone, err := c.ZoneForName(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := batches[zone.ID]; !ok {
+			batches[zone.ID] = &CloudflareBatchReq{}
+			plans[zone.ID] = &Plan{}
+			zoneIDs = append(zoneIDs, zone.ID)
+		}
+		return batches[zone.ID], plans[zone.ID], nil
 	}
-	if record.ID == "" {
-		_, err = c.CreateRecord(contentType, name, content, 1, proxied)
+	for _, record := range plan.Deletes {
+		batch, zonePlan, err := batchFor(record.Name)
 		if err != nil {
-			//fmt.Printf("Failed to create TXT record for %v: %v\n", name, err)
 			return err
 		}
-	} else {
-		//Copy the ID since we don't care about comparing it
-		newRecord := CloudflareRecord{
-			ID:         record.ID,
-			RecordType: contentType,
-			Name:       name,
-			Content:    content,
-			TTL:        ttl,
-			Proxied:    proxied,
+		batch.Deletes = append(batch.Deletes, CloudflareBatchDelete{ID: record.ID})
+		zonePlan.Deletes = append(zonePlan.Deletes, record)
+	}
+	for _, record := range plan.Updates {
+		batch, zonePlan, err := batchFor(record.Name)
+		if err != nil {
+			return err
 		}
-		if record != newRecord {
-			_, err = c.UpdateRecordByID(record.ID, contentType, name, content, 1, proxied)
-			if err != nil {
-				//fmt.Printf("Failed to update TXT record for %v: %v\n", name, err)
-				return err
-			}
+		batch.Puts = append(batch.Puts, CloudflareRecord(record))
+		zonePlan.Updates = append(zonePlan.Updates, record)
+	}
+	for _, record := range plan.Creates {
+		batch, zonePlan, err := batchFor(record.Name)
+		if err != nil {
+			return err
 		}
+		zonePlan.Creates = append(zonePlan.Creates, record)
+		batch.Posts = append(batch.Posts, CloudflareRecordReq{
+			RecordType: record.RecordType,
+			Name:       record.Name,
+			Content:    record.Content,
+			TTL:        record.TTL,
+			Proxied:    record.Proxied,
+		})
 	}
 
+	for i, zoneID := range zoneIDs {
+		body := new(bytes.Buffer)
+		json.NewEncoder(body).Encode(batches[zoneID])
+		respBody := CloudflareBatchResp{}
+		err := c.CallAPI("POST", "/zones/"+zoneID+"/dns_records/batch", body, &respBody)
+
+		//Accounts without the batch endpoint get "No route for that URI"
+		var apiErr *CloudflareAPIError
+		if i == 0 && errors.As(err, &apiErr) && (apiErr.HasCode(7000) || apiErr.HasCode(7003)) {
+			return ErrBatchUnsupported
+		}
+		if err == nil && !respBody.Success {
+			err = cloudflareError(respBody.Errors)
+		}
+		if err != nil {
+			batchErr := &BatchError{Err: err}
+			for j, zoneID := range zoneIDs {
+				if j < i {
+					batchErr.Applied = batchErr.Applied.Merge(*plans[zoneID])
+				} else {
+					batchErr.Remaining = batchErr.Remaining.Merge(*plans[zoneID])
+				}
+			}
+			return batchErr
+		}
+	}
 	return nil
 }
 
@@ -335,46 +644,22 @@ func (c *Cloudflare) PatchRecordByID() {
 
 }
 
-//DeleteRecordByName - Delete record
-func (c *Cloudflare) DeleteRecordByName(recordType, name string) error {
-	record, err := c.GetRecord(recordType, name)
-	if err != nil {
-		return err
-	}
-
-	c.mux.Lock()
-	url := "https://api.cloudflare.com/client/v4/zones/" + c.ZoneID + "/dns_records/" + record.ID
-	//fmt.Println(url)
-	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("X-Auth-Email", c.AuthEmail)
-	req.Header.Add("X-Auth-Key", c.AuthToken)
-	req.Header.Add("Content-type", "application/json")
-	c.mux.Unlock()
-
-	resp, err := client.Do(req)
+//DeleteRecord - Delete record by ID
+func (c *Cloudflare) DeleteRecord(record DNSRecord) error {
+	zone, err := c.ZoneForName(record.Name)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close() //Close the resp body when finished
 
 	respBody := CloudflareSingleResp{}
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	err = c.CallAPI("DELETE", "/zones/"+zone.ID+"/dns_records/"+record.ID, nil, &respBody)
 	if err != nil {
 		return err
 	}
 
 	//Check if success, print errors from api if not.
-	var errMessage string
 	if !respBody.Success {
-		for _, e := range respBody.Errors {
-			code := strconv.Itoa(e.Code)
-			errMessage += "Error code " + code + ", " + e.Message + "."
-		}
-		return errors.New(errMessage)
+		return cloudflareError(respBody.Errors)
 	}
 
 	return nil
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+)
+
+//newTestCloudflare - Start a fake API serving example.com and a client with its zones loaded.
+//The caller must close the server.
+func newTestCloudflare(t *testing.T) (*Cloudflare, *cloudflaretest.Server) {
+	t.Helper()
+	server := cloudflaretest.NewServer()
+	server.Token = "test-token"
+	server.AddZone("zone1", "example.com")
+
+	cf := NewCloudflare("", "", "test-token", nil, 0)
+	cf.BaseURL = server.URL
+	if err := cf.LoadZones(); err != nil {
+		t.Fatalf("LoadZones() error = %v", err)
+	}
+	return cf, server
+}
+
+func TestCloudflareVerify(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	if err := cf.Verify(); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	server.TokenStatus = "disabled"
+	if err := cf.Verify(); err == nil {
+		t.Fatal("Verify() with a disabled token succeeded")
+	}
+
+	cf.APIToken = "wrong-token"
+	if err := cf.Verify(); err == nil {
+		t.Fatal("Verify() with the wrong token succeeded")
+	}
+}
+
+func TestCloudflareAuthHeaders(t *testing.T) {
+	server := cloudflaretest.NewServer()
+	defer server.Close()
+	server.AddZone("zone1", "example.com")
+
+	cf := NewCloudflare("user@example.com", "global-key", "", nil, 0)
+	cf.BaseURL = server.URL
+	if err := cf.LoadZones(); err != nil {
+		t.Fatalf("LoadZones() with email and key error = %v", err)
+	}
+
+	cf = NewCloudflare("", "", "", nil, 0)
+	cf.BaseURL = server.URL
+	if err := cf.LoadZones(); err == nil {
+		t.Fatal("LoadZones() without credentials succeeded")
+	}
+}
+
+func TestCloudflareLoadZones(t *testing.T) {
+	server := cloudflaretest.NewServer()
+	defer server.Close()
+	server.AddZone("zone1", "example.com")
+	server.AddZone("zone2", "dev.example.com")
+	server.AddZoneWithPermissions("zone3", "readonly.org", []string{"#dns_records:read"})
+
+	tests := []struct {
+		name      string
+		zoneNames []string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "by id", zoneNames: []string{"zone1"}, want: []string{"example.com"}},
+		{name: "by name", zoneNames: []string{"example.com", "DEV.example.com"}, want: []string{"dev.example.com", "example.com"}},
+		{name: "unknown zone", zoneNames: []string{"example.net"}, wantErr: true},
+		{name: "missing edit permission", zoneNames: []string{"readonly.org"}, wantErr: true},
+		{name: "discover zones", zoneNames: nil, want: []string{"dev.example.com", "example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf := NewCloudflare("user@example.com", "global-key", "", tt.zoneNames, 0)
+			cf.BaseURL = server.URL
+			err := cf.LoadZones()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadZones() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, zone := range cf.Zones {
+				got = append(got, zone.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Zones = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudflareZoneForName(t *testing.T) {
+	server := cloudflaretest.NewServer()
+	defer server.Close()
+	server.AddZone("zone1", "example.com")
+	server.AddZone("zone2", "dev.example.com")
+
+	cf := NewCloudflare("user@example.com", "global-key", "", nil, 0)
+	cf.BaseURL = server.URL
+	if err := cf.LoadZones(); err != nil {
+		t.Fatalf("LoadZones() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"example.com":            "zone1",
+		"www.example.com":        "zone1",
+		"hello.dev.example.com":  "zone2",
+		"Hello.Dev.Example.com.": "zone2",
+		"dev.example.com":        "zone2",
+		"notexample.com":         "",
+		"example.org":            "",
+	}
+	for name, want := range tests {
+		zone, err := cf.ZoneForName(name)
+		if want == "" {
+			var notManaged *ZoneNotManagedError
+			if !errors.As(err, &notManaged) {
+				t.Errorf("ZoneForName(%q) error = %v, want ZoneNotManagedError", name, err)
+			}
+			continue
+		}
+		if err != nil || zone.ID != want {
+			t.Errorf("ZoneForName(%q) = %v, %v, want %v", name, zone.ID, err, want)
+		}
+	}
+}
+
+func TestCloudflareListRecordsPaginates(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	cf.PerPage = 2
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: name + ".example.com", Content: "service/default/" + name})
+	}
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "a.example.com", Content: "1.2.3.4"})
+
+	records, err := cf.ListRecords(RecordFilter{RecordType: "TXT"})
+	if err != nil {
+		t.Fatalf("ListRecords() error = %v", err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("ListRecords() returned %v records, want 5", len(records))
+	}
+	if records[4].Name != "e.example.com" {
+		t.Errorf("last record = %v, want e.example.com", records[4].Name)
+	}
+
+	records, err = cf.ListRecords(RecordFilter{RecordType: "TXT", Content: "service/default/d"})
+	if err != nil || len(records) != 1 || records[0].Name != "d.example.com" {
+		t.Errorf("ListRecords() by content = %v, %v", records, err)
+	}
+}
+
+func TestCloudflareRecordLifecycle(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+
+	created, err := cf.CreateRecord(DNSRecord{RecordType: "A", Name: "www.example.com", Content: "1.2.3.4", TTL: 1, Proxied: true})
+	if err != nil {
+		t.Fatalf("CreateRecord() error = %v", err)
+	}
+	if created.ID == "" || !created.Proxied {
+		t.Fatalf("CreateRecord() = %+v", created)
+	}
+
+	got, err := cf.GetRecord("A", "www.example.com")
+	if err != nil || got != created {
+		t.Fatalf("GetRecord() = %+v, %v, want %+v", got, err, created)
+	}
+
+	created.Content = "5.6.7.8"
+	if _, err := cf.UpdateRecord(created); err != nil {
+		t.Fatalf("UpdateRecord() error = %v", err)
+	}
+	if records := server.FindRecords("A", "www.example.com"); len(records) != 1 || records[0].Content != "5.6.7.8" {
+		t.Fatalf("records after update = %+v", records)
+	}
+
+	if err := cf.DeleteRecord(created); err != nil {
+		t.Fatalf("DeleteRecord() error = %v", err)
+	}
+	if records := server.Records(""); len(records) != 0 {
+		t.Fatalf("records after delete = %+v", records)
+	}
+
+	got, err = cf.GetRecord("A", "www.example.com")
+	if err != nil || got.ID != "" {
+		t.Fatalf("GetRecord() of deleted record = %+v, %v", got, err)
+	}
+}
+
+func TestCloudflareErrors(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+
+	server.FailNext(http.StatusBadRequest, 81057, "Record already exists")
+	_, err := cf.CreateRecord(DNSRecord{RecordType: "A", Name: "www.example.com", Content: "1.2.3.4", TTL: 1})
+	if err == nil || err.Error() != "Error code 81057, Record already exists." {
+		t.Errorf("CreateRecord() error = %v", err)
+	}
+
+	server.RateLimitNext(1, 1)
+	if _, err := cf.ListRecords(RecordFilter{}); err == nil || isPermanent(err) {
+		t.Errorf("ListRecords() while rate limited error = %v", err)
+	}
+	if tokens := cf.Limiter.Tokens(); tokens != 0 {
+		t.Errorf("Limiter.Tokens() after a 429 = %v, want 0", tokens)
+	}
+
+	if _, err := cf.CreateRecord(DNSRecord{RecordType: "A", Name: "www.example.org", Content: "1.2.3.4", TTL: 1}); err == nil {
+		t.Error("CreateRecord() outside the managed zones succeeded")
+	}
+}
+
+func TestSyncRecord(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	record := DNSRecord{RecordType: "A", Name: "www.example.com", Content: "1.2.3.4", TTL: 1}
+
+	if result, err := syncRecord(cf, record); result != RecordCreated || err != nil {
+		t.Fatalf("syncRecord() create = %v, %v", result, err)
+	}
+	server.ResetRequests()
+	if result, err := syncRecord(cf, record); result != RecordUnchanged || err != nil {
+		t.Fatalf("syncRecord() unchanged = %v, %v", result, err)
+	}
+	for _, request := range server.Requests() {
+		if request[:3] != "GET" {
+			t.Errorf("syncRecord() of an unchanged record made request %v", request)
+		}
+	}
+
+	record.Content = "5.6.7.8"
+	if result, err := syncRecord(cf, record); result != RecordUpdated || err != nil {
+		t.Fatalf("syncRecord() update = %v, %v", result, err)
+	}
+	want := []string{"A www.example.com 5.6.7.8"}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestCallAPIErrorTypes(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	//Without a Retry-After header a 429 would hold the next request for a minute
+	cf.Limiter = nil
+
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{status: http.StatusTooManyRequests},
+		{status: http.StatusBadGateway},
+		{status: http.StatusBadRequest, permanent: true},
+		{status: http.StatusForbidden, permanent: true},
+	}
+	for _, tt := range tests {
+		server.FailNext(tt.status, 1000, "Failed")
+		_, err := cf.ListRecords(RecordFilter{})
+		var retryable *RetryableError
+		if err == nil || isPermanent(err) != tt.permanent || errors.As(err, &retryable) == tt.permanent {
+			t.Errorf("ListRecords() with status %v error = %#v", tt.status, err)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+//Package cloudflaretest provides an in-process fake of the Cloudflare v4 API for tests.
+//It implements token verification, zone listing and the dns_records endpoints, including
+//batch, against zone state held in memory. Point a client's base URL at Server.URL to use it.
+package cloudflaretest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Zone - A zone served by the fake. Permissions is returned as is from the zone endpoints.
+type Zone struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+//Record - A DNS record held by the fake
+type Record struct {
+	ID         string `json:"id"`
+	RecordType string `json:"type"`
+	Name       string `json:"name"`
+	Content    string `json:"content"`
+	TTL        int    `json:"ttl"`
+	Proxied    bool   `json:"proxied"`
+	ZoneID     string `json:"zone_id"`
+}
+
+//Error - An entry of the errors list in the response envelope
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type resultInfo struct {
+	Count      int `json:"count"`
+	TotalCount int `json:"total_count"`
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalPages int `json:"total_pages"`
+}
+
+type envelope struct {
+	Success    bool        `json:"success"`
+	Result     interface{} `json:"result"`
+	ResultInfo *resultInfo `json:"result_info,omitempty"`
+	Errors     []Error     `json:"errors"`
+	Messages   []string    `json:"messages"`
+}
+
+type failure struct {
+	status     int
+	retryAfter string
+	err        Error
+}
+
+//Server - Fake Cloudflare API. If Token is set requests must use it as a Bearer token,
+//otherwise any X-Auth-Email/X-Auth-Key pair is accepted. DisableBatch makes the batch
+//endpoint respond like an unknown route.
+type Server struct {
+	*httptest.Server
+	Token        string
+	TokenStatus  string
+	DisableBatch bool
+	zones        []Zone
+	records      map[string]Record
+	order        []string
+	nextID       int
+	failures     []failure
+	requests     []string
+	mux          sync.Mutex
+}
+
+//NewServer - Start a fake with no zones
+func NewServer() *Server {
+	s := &Server{
+		TokenStatus: "active",
+		records:     map[string]Record{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+//AddZone - Serve a zone with permission to edit DNS records
+func (s *Server) AddZone(id, name string) Zone {
+	return s.AddZoneWithPermissions(id, name, []string{"#dns_records:read", "#dns_records:edit"})
+}
+
+//AddZoneWithPermissions - Serve a zone reporting the given permissions
+func (s *Server) AddZoneWithPermissions(id, name string, permissions []string) Zone {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	zone := Zone{ID: id, Name: name, Permissions: permissions}
+	s.zones = append(s.zones, zone)
+	return zone
+}
+
+//AddRecord - Store a record in the zone, the ID is generated
+func (s *Server) AddRecord(zoneID string, record Record) Record {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.addRecord(zoneID, record)
+}
+
+func (s *Server) addRecord(zoneID string, record Record) Record {
+	s.nextID++
+	record.ID = "record" + strconv.Itoa(s.nextID)
+	record.ZoneID = zoneID
+	if record.TTL == 0 {
+		record.TTL = 1
+	}
+	s.records[record.ID] = record
+	s.order = append(s.order, record.ID)
+	return record
+}
+
+//Records - Records in the zone in creation order. An empty zone ID returns every record.
+func (s *Server) Records(zoneID string) []Record {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.filter(zoneID, func(Record) bool { return true })
+}
+
+//FindRecords - Records of the type and name in any zone
+func (s *Server) FindRecords(recordType, name string) []Record {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.filter("", func(r Record) bool {
+		return r.RecordType == recordType && r.Name == name
+	})
+}
+
+func (s *Server) filter(zoneID string, match func(Record) bool) []Record {
+	records := []Record{}
+	for _, id := range s.order {
+		record, ok := s.records[id]
+		if ok && (zoneID == "" || record.ZoneID == zoneID) && match(record) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+//FailNext - Respond to the next request with an error envelope and the HTTP status
+func (s *Server) FailNext(status, code int, message string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.failures = append(s.failures, failure{status: status, err: Error{Code: code, Message: message}})
+}
+
+//RateLimitNext - Respond to the next n requests with 429 and a Retry-After header
+func (s *Server) RateLimitNext(n int, retryAfter int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, failure{
+			status:     http.StatusTooManyRequests,
+			retryAfter: strconv.Itoa(retryAfter),
+			err:        Error{Code: 971, Message: "Please wait and consider throttling your request speed"},
+		})
+	}
+}
+
+//Requests - Method and path of every request received, e.g. "GET /zones/abc/dns_records"
+func (s *Server) Requests() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+//ResetRequests - Forget the requests received so far
+func (s *Server) ResetRequests() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.requests = nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		writeError(w, f.status, f.err.Code, f.err.Message)
+		return
+	}
+
+	if !s.authorized(r) {
+		writeError(w, http.StatusBadRequest, 6003, "Invalid request headers")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "user" && parts[1] == "tokens" && parts[2] == "verify" && r.Method == "GET":
+		s.verifyToken(w)
+	case len(parts) == 1 && parts[0] == "zones" && r.Method == "GET":
+		s.listZones(w, r)
+	case len(parts) == 2 && parts[0] == "zones" && r.Method == "GET":
+		s.getZone(w, parts[1])
+	case len(parts) == 3 && parts[0] == "zones" && parts[2] == "dns_records":
+		s.handleRecords(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "zones" && parts[2] == "dns_records" && parts[3] == "batch" && r.Method == "POST" && !s.DisableBatch:
+		s.batchRecords(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "zones" && parts[2] == "dns_records" && parts[3] != "batch":
+		s.handleRecord(w, r, parts[1], parts[3])
+	default:
+		writeError(w, http.StatusNotFound, 7000, "No route for that URI")
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token != "" {
+		return r.Header.Get("Authorization") == "Bearer "+s.Token
+	}
+	return r.Header.Get("Authorization") != "" || (r.Header.Get("X-Auth-Email") != "" && r.Header.Get("X-Auth-Key") != "")
+}
+
+func (s *Server) verifyToken(w http.ResponseWriter) {
+	if s.Token == "" {
+		writeError(w, http.StatusBadRequest, 1000, "Invalid API Token")
+		return
+	}
+	writeResult(w, http.StatusOK, map[string]string{"id": "token", "status": s.TokenStatus}, nil)
+}
+
+func (s *Server) listZones(w http.ResponseWriter, r *http.Request) {
+	zones := make([]interface{}, 0, len(s.zones))
+	for _, zone := range s.zones {
+		zones = append(zones, zone)
+	}
+	page, info := paginate(r, zones)
+	writeResult(w, http.StatusOK, page, info)
+}
+
+func (s *Server) getZone(w http.ResponseWriter, zoneID string) {
+	zone, ok := s.zone(zoneID)
+	if !ok {
+		writeError(w, http.StatusNotFound, 1001, "Invalid zone identifier")
+		return
+	}
+	writeResult(w, http.StatusOK, zone, nil)
+}
+
+func (s *Server) zone(zoneID string) (Zone, bool) {
+	for _, zone := range s.zones {
+		if zone.ID == zoneID {
+			return zone, true
+		}
+	}
+	return Zone{}, false
+}
+
+func (s *Server) handleRecords(w http.ResponseWriter, r *http.Request, zoneID string) {
+	if _, ok := s.zone(zoneID); !ok {
+		writeError(w, http.StatusNotFound, 1001, "Invalid zone identifier")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		matched := s.filter(zoneID, func(record Record) bool {
+			return (query.Get("type") == "" || query.Get("type") == record.RecordType) &&
+				(query.Get("name") == "" || query.Get("name") == record.Name) &&
+				(query.Get("content") == "" || query.Get("content") == record.Content)
+		})
+		records := make([]interface{}, 0, len(matched))
+		for _, record := range matched {
+			records = append(records, record)
+		}
+		page, info := paginate(r, records)
+		writeResult(w, http.StatusOK, page, info)
+	case "POST":
+		record, ok := decodeRecord(w, r)
+		if !ok {
+			return
+		}
+		writeResult(w, http.StatusOK, s.addRecord(zoneID, record), nil)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, 10000, "Method not allowed")
+	}
+}
+
+func (s *Server) handleRecord(w http.ResponseWriter, r *http.Request, zoneID, id string) {
+	existing, ok := s.records[id]
+	if !ok || existing.ZoneID != zoneID {
+		writeError(w, http.StatusNotFound, 81044, "Record does not exist.")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeResult(w, http.StatusOK, existing, nil)
+	case "PUT":
+		record, ok := decodeRecord(w, r)
+		if !ok {
+			return
+		}
+		record.ID = existing.ID
+		record.ZoneID = zoneID
+		if record.TTL == 0 {
+			record.TTL = 1
+		}
+		s.records[id] = record
+		writeResult(w, http.StatusOK, record, nil)
+	case "PATCH":
+		patch := map[string]json.RawMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeError(w, http.StatusBadRequest, 9207, "Request body is invalid.")
+			return
+		}
+		merged, _ := json.Marshal(existing)
+		current := map[string]json.RawMessage{}
+		json.Unmarshal(merged, &current)
+		for field, value := range patch {
+			current[field] = value
+		}
+		merged, _ = json.Marshal(current)
+		record := Record{}
+		json.Unmarshal(merged, &record)
+		record.ID = existing.ID
+		record.ZoneID = zoneID
+		s.records[id] = record
+		writeResult(w, http.StatusOK, record, nil)
+	case "DELETE":
+		delete(s.records, id)
+		writeResult(w, http.StatusOK, map[string]string{"id": id}, nil)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, 10000, "Method not allowed")
+	}
+}
+
+//batch - Body of the batch endpoint, applied in the order deletes, puts, posts
+type batch struct {
+	Deletes []Record `json:"deletes"`
+	Puts    []Record `json:"puts"`
+	Posts   []Record `json:"posts"`
+}
+
+//batchRecords - Apply every change of the batch or, if any of them is invalid, none of them
+func (s *Server) batchRecords(w http.ResponseWriter, r *http.Request, zoneID string) {
+	if _, ok := s.zone(zoneID); !ok {
+		writeError(w, http.StatusNotFound, 1001, "Invalid zone identifier")
+		return
+	}
+	body := batch{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, 9207, "Request body is invalid.")
+		return
+	}
+	for _, record := range append(append([]Record{}, body.Deletes...), body.Puts...) {
+		if existing, ok := s.records[record.ID]; !ok || existing.ZoneID != zoneID {
+			writeError(w, http.StatusNotFound, 81044, "Record does not exist.")
+			return
+		}
+	}
+	for _, record := range append(append([]Record{}, body.Puts...), body.Posts...) {
+		if record.RecordType == "" || record.Name == "" || record.Content == "" {
+			writeError(w, http.StatusBadRequest, 9005, "DNS record type, name and content are required.")
+			return
+		}
+	}
+
+	result := batch{Deletes: []Record{}, Puts: []Record{}, Posts: []Record{}}
+	for _, record := range body.Deletes {
+		result.Deletes = append(result.Deletes, s.records[record.ID])
+		delete(s.records, record.ID)
+	}
+	for _, record := range body.Puts {
+		record.ZoneID = zoneID
+		if record.TTL == 0 {
+			record.TTL = 1
+		}
+		s.records[record.ID] = record
+		result.Puts = append(result.Puts, record)
+	}
+	for _, record := range body.Posts {
+		result.Posts = append(result.Posts, s.addRecord(zoneID, record))
+	}
+	writeResult(w, http.StatusOK, result, nil)
+}
+
+func decodeRecord(w http.ResponseWriter, r *http.Request) (Record, bool) {
+	record := Record{}
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		writeError(w, http.StatusBadRequest, 9207, "Request body is invalid.")
+		return Record{}, false
+	}
+	if record.RecordType == "" || record.Name == "" || record.Content == "" {
+		writeError(w, http.StatusBadRequest, 9005, "DNS record type, name and content are required.")
+		return Record{}, false
+	}
+	return record, true
+}
+
+//paginate - Slice the items according to the page and per_page query parameters
+func paginate(r *http.Request, items []interface{}) ([]interface{}, *resultInfo) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = 100
+	}
+
+	totalPages := (len(items) + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + perPage
+	if end > len(items) {
+		end = len(items)
+	}
+
+	return items[start:end], &resultInfo{
+		Count:      end - start,
+		TotalCount: len(items),
+		Page:       page,
+		PerPage:    perPage,
+		TotalPages: totalPages,
+	}
+}
+
+func writeResult(w http.ResponseWriter, status int, result interface{}, info *resultInfo) {
+	writeEnvelope(w, status, envelope{Success: true, Result: result, ResultInfo: info, Errors: []Error{}, Messages: []string{}})
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	writeEnvelope(w, status, envelope{Success: false, Errors: []Error{{Code: code, Message: message}}, Messages: []string{}})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, body envelope) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+//RecordStrings - "TYPE name content" for each record, sorted, for comparing zone contents in tests
+func RecordStrings(records []Record) []string {
+	names := []string{}
+	for _, record := range records {
+		names = append(names, record.RecordType+" "+record.Name+" "+record.Content)
+	}
+	sort.Strings(names)
+	return names
+}
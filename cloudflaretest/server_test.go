@@ -0,0 +1,104 @@
+package cloudflaretest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func do(t *testing.T, s *Server, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decoded := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, decoded
+}
+
+func TestServerPatchRecord(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Token = "token"
+	s.AddZone("zone1", "example.com")
+	record := s.AddRecord("zone1", Record{RecordType: "A", Name: "www.example.com", Content: "1.2.3.4"})
+
+	status, _ := do(t, s, "PATCH", "/zones/zone1/dns_records/"+record.ID, `{"proxied":true}`)
+	if status != http.StatusOK {
+		t.Fatalf("PATCH status = %v", status)
+	}
+	got := s.Records("zone1")[0]
+	if !got.Proxied || got.Content != "1.2.3.4" {
+		t.Errorf("record after PATCH = %+v", got)
+	}
+}
+
+func TestServerPaginationAndErrors(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Token = "token"
+	s.AddZone("zone1", "example.com")
+	for i := 0; i < 3; i++ {
+		s.AddRecord("zone1", Record{RecordType: "TXT", Name: "example.com", Content: "text"})
+	}
+
+	_, body := do(t, s, "GET", "/zones/zone1/dns_records?type=TXT&per_page=2&page=2", "")
+	info := body["result_info"].(map[string]interface{})
+	if len(body["result"].([]interface{})) != 1 || info["total_pages"].(float64) != 2 {
+		t.Errorf("page 2 = %v", body)
+	}
+
+	s.RateLimitNext(1, 5)
+	status, body := do(t, s, "GET", "/zones/zone1/dns_records", "")
+	if status != http.StatusTooManyRequests || body["success"].(bool) {
+		t.Errorf("rate limited response = %v %v", status, body)
+	}
+
+	status, _ = do(t, s, "DELETE", "/zones/zone1/dns_records/missing", "")
+	if status != http.StatusNotFound {
+		t.Errorf("DELETE of a missing record status = %v", status)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Token = "token"
+	s.AddZone("zone1", "example.com")
+	old := s.AddRecord("zone1", Record{RecordType: "A", Name: "old.example.com", Content: "1.2.3.4"})
+	www := s.AddRecord("zone1", Record{RecordType: "A", Name: "www.example.com", Content: "1.2.3.4"})
+
+	//A batch with an unknown record changes nothing
+	status, _ := do(t, s, "POST", "/zones/zone1/dns_records/batch", `{"deletes":[{"id":"`+old.ID+`"},{"id":"missing"}]}`)
+	if status != http.StatusNotFound || len(s.Records("zone1")) != 2 {
+		t.Fatalf("invalid batch status = %v, records = %v", status, s.Records("zone1"))
+	}
+
+	status, _ = do(t, s, "POST", "/zones/zone1/dns_records/batch", `{
+		"deletes": [{"id": "`+old.ID+`"}],
+		"puts": [{"id": "`+www.ID+`", "type": "A", "name": "www.example.com", "content": "5.6.7.8"}],
+		"posts": [{"type": "TXT", "name": "www.example.com", "content": "owner"}]
+	}`)
+	if status != http.StatusOK {
+		t.Fatalf("batch status = %v", status)
+	}
+	want := []string{"A www.example.com 5.6.7.8", "TXT www.example.com owner"}
+	if got := RecordStrings(s.Records("zone1")); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("records after batch = %v, want %v", got, want)
+	}
+
+	s.DisableBatch = true
+	if status, _ := do(t, s, "POST", "/zones/zone1/dns_records/batch", `{}`); status != http.StatusNotFound {
+		t.Errorf("disabled batch status = %v", status)
+	}
+}
@@ -1,41 +1,75 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/networking/v1beta1"
-	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
+//ControllerConfig - Cluster wide settings for the controller
+type ControllerConfig struct {
+	//IngressHostsFromRules publishes records for the rule and TLS hosts of every Ingress
+	//unless it is overridden by the from-rules annotation
+	IngressHostsFromRules bool
+	//GCInterval is how often records of deleted objects are collected, 0 disables it
+	GCInterval time.Duration
+	//GCDryRun only reports the records the collector would delete
+	GCDryRun bool
+	//OwnerID is stored in the TXT records so controllers of several clusters can share a zone
+	OwnerID string
+	//RegistryPrefix and RegistrySuffix are added to the first label of a hostname to get the
+	//name of its TXT record
+	RegistryPrefix string
+	RegistrySuffix string
+	//ReconcileMode is ReconcileRecord or ReconcilePlan
+	ReconcileMode string
+	//Policy is the sync policy of objects without the policy annotation, including deleted ones
+	Policy string
+	//DryRun is set when the provider only logs changes, so events say what would have changed
+	DryRun bool
+}
+
 type Controller struct {
+	config          ControllerConfig
 	currentIP       *CurrentIP
-	cf              Cloudflare
+	provider        DNSProvider
+	recorder        record.EventRecorder
 	queue           workqueue.RateLimitingInterface
 	serviceIndexer  cache.Indexer
 	serviceInformer cache.Controller
 	ingressIndexer  cache.Indexer
 	ingressInformer cache.Controller
+	reconcileMux    sync.Mutex
 }
 
 func NewController(
+	config ControllerConfig,
 	currentIP *CurrentIP,
-	cf Cloudflare,
+	provider DNSProvider,
+	recorder record.EventRecorder,
 	queue workqueue.RateLimitingInterface,
 	serviceIndexer cache.Indexer,
 	serviceInformer cache.Controller,
 	ingressIndexer cache.Indexer,
 	ingressInformer cache.Controller) *Controller {
 	return &Controller{
+		config:          config,
 		currentIP:       currentIP,
-		cf:              cf,
+		provider:        provider,
+		recorder:        recorder,
 		queue:           queue,
 		serviceIndexer:  serviceIndexer,
 		serviceInformer: serviceInformer,
@@ -53,53 +87,205 @@ func (c *Controller) processNextItem() bool {
 
 	defer c.queue.Done(key)
 
-	err := c.cloudflareSync(key.(string))
+	//In plan mode the queue only holds reconcileKey, and one reconcile applies the changes of every object
+	var err error
+	if c.config.ReconcileMode == ReconcilePlan {
+		err = c.reconcile()
+	} else {
+		err = c.cloudflareSync(key.(string))
+	}
 	c.handleErr(err, key)
 
 	return true
 }
 
-//Delete both TXT and A record for key
+//Delete the TXT record and the A and AAAA records for key, unless the policy stored in the TXT
+//record doesn't allow deletes
 func (c *Controller) cloudflareDeleteRecordPair(key string) error {
-	records, err := c.cf.ListTXTRecords()
+	records, err := c.ownedRecords(key)
 	if err != nil {
-		fmt.Printf("Failed to get list of txt records:  %v\n", err)
-		return nil
+		return fmt.Errorf("Failed to get list of txt records: %w", err)
 	}
+	//The object is gone, so there is nothing to record events on
+	var firstErr error
 	for _, record := range records {
-		if record.Content == key {
-			err = c.cf.DeleteRecordByName("A", record.Name)
-			if err != nil {
-				fmt.Printf("Failed to delete A record:  %v\n", err)
-			}
-			err = c.cf.DeleteRecordByName("TXT", record.Name)
-			if err != nil {
-				fmt.Printf("Failed to delete TXT record:  %v\n", err)
-			}
+		entry, _ := parseRegistryContent(record.Content)
+		if policy := c.registryPolicy(entry); !policyAllowsDelete(policy) {
+			fmt.Printf("Keeping the records of %v for %v with the %v policy\n", c.hostnameFromRegistry(record.Name), key, policy)
+			continue
+		}
+		if err := c.deleteOwnedRecords(nil, record); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
 
-	return nil
+	return firstErr
 }
 
-//Create both TXT and A record for key
-func (c *Controller) cloudflareSyncRecordPair(key, hostname, ip string, proxied bool) error {
-	err := c.cf.SyncRecord("TXT", hostname, key, 1, false)
+//cloudflareDeleteDroppedRecords - Delete the records owned by key for names that are no longer wanted,
+//found through the TXT records so names from older versions of the object are cleaned up too
+func (c *Controller) cloudflareDeleteDroppedRecords(key string, object runtime.Object, hostnames []string) error {
+	records, err := c.ownedRecords(key)
 	if err != nil {
-		fmt.Printf("Failed trying to get TXT record for %v: %v\n", key, err)
-		return nil
+		return fmt.Errorf("Failed to get list of txt records: %w", err)
+	}
+	var firstErr error
+	for _, record := range records {
+		hostname := c.hostnameFromRegistry(record.Name)
+		if containsHostname(hostnames, hostname) {
+			continue
+		}
+		fmt.Printf("Removing %v, hostname %v is no longer wanted\n", key, hostname)
+		if err := c.deleteOwnedRecords(object, record); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	publicIP := c.currentIP.Get()
-	err = c.cf.SyncRecord("A", hostname, publicIP, 1, proxied)
+	return firstErr
+}
+
+//deleteOwnedRecords - Delete the A and AAAA records the TXT record says were published for the
+//hostname, then the TXT record. Events are recorded on the object unless it is nil. The TXT
+//record is kept if an A or AAAA record couldn't be deleted, so the next attempt can find them again.
+func (c *Controller) deleteOwnedRecords(object runtime.Object, txtRecord DNSRecord) error {
+	hostname := c.hostnameFromRegistry(txtRecord.Name)
+	entry, _ := parseRegistryContent(txtRecord.Content)
+	for _, recordType := range []string{"A", "AAAA"} {
+		if !entry.publishes(recordType) {
+			continue
+		}
+		deleted, err := deleteRecordByName(c.provider, recordType, hostname)
+		if err != nil {
+			return fmt.Errorf("Failed to delete %v record %v: %w", recordType, hostname, err)
+		}
+		if deleted {
+			c.recordDeleted(object, recordType, hostname)
+		}
+	}
+	err := c.provider.DeleteRecord(txtRecord)
 	if err != nil {
-		fmt.Printf("Failed trying to get TXT record for %v: %v\n", key, err)
-		return nil
+		return fmt.Errorf("Failed to delete TXT record %v: %w", txtRecord.Name, err)
 	}
-
+	c.recordDeleted(object, "TXT", txtRecord.Name)
 	return nil
 }
 
+//eventf - Record an event on the object, if there is one
+func (c *Controller) eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if object != nil {
+		c.recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+//recordSynced - Record an event if syncRecord changed the record
+func (c *Controller) recordSynced(object runtime.Object, result SyncResult, recordType, name, content string) {
+	//Nothing was changed in a dry run, so the event only says what would have been
+	if c.config.DryRun {
+		switch result {
+		case RecordCreated:
+			c.eventf(object, v1.EventTypeNormal, "DryRun", "Would create %v record %v with %v", recordType, name, content)
+		case RecordUpdated:
+			c.eventf(object, v1.EventTypeNormal, "DryRun", "Would update %v record %v to %v", recordType, name, content)
+		}
+		return
+	}
+	switch result {
+	case RecordCreated:
+		c.eventf(object, v1.EventTypeNormal, "RecordCreated", "Created %v record %v with %v", recordType, name, content)
+	case RecordUpdated:
+		c.eventf(object, v1.EventTypeNormal, "RecordUpdated", "Updated %v record %v to %v", recordType, name, content)
+	}
+}
+
+//Create the TXT record for key and the A and/or AAAA records for the families of the spec. A
+//record of a family that isn't wanted, or that has no public address, is deleted if the TXT
+//record says the controller published it, records added by hand next to the controller's are
+//left alone. The policy decides if existing records may be updated or deleted.
+func (c *Controller) cloudflareSyncRecordPair(key, hostname string, spec recordSpec) error {
+	object, policy := spec.Object, spec.Policy
+	result, previous, err := c.syncRegistryRecord(key, hostname, spec)
+	if conflict, ok := err.(*OwnershipConflictError); ok {
+		return conflict
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to sync TXT record of %v: %w", hostname, err)
+	}
+	c.recordSynced(object, result, "TXT", c.registryName(hostname), registryContent(c.config.OwnerID, key, spec.Family, spec.AnnotatedPolicy))
+
+	var firstErr error
+	for _, address := range c.addresses(spec.Family) {
+		if !address.wanted || address.ip == "" {
+			if !policyAllowsDelete(policy) || !previous.publishes(address.recordType) {
+				continue
+			}
+			deleted, err := deleteRecordByName(c.provider, address.recordType, hostname)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("Failed to delete %v record %v: %w", address.recordType, hostname, err)
+			}
+			if deleted && err == nil {
+				c.recordDeleted(object, address.recordType, hostname)
+			}
+			continue
+		}
+		record := DNSRecord{RecordType: address.recordType, Name: hostname, Content: address.ip, TTL: 1, Proxied: spec.Proxied}
+		var result SyncResult
+		if policyAllowsUpdate(policy) {
+			result, err = syncRecord(c.provider, record)
+		} else {
+			result, err = createMissingRecord(c.provider, record)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Failed to sync %v record %v: %w", address.recordType, hostname, err)
+			}
+			continue
+		}
+		c.recordSynced(object, result, address.recordType, hostname, address.ip)
+	}
+
+	return firstErr
+}
+
+//recordAddress - The address an A or AAAA record should have. The record is deleted if it isn't
+//wanted or there is no public address of its family.
+type recordAddress struct {
+	recordType string
+	wanted     bool
+	ip         string
+}
+
+//addresses - The A and AAAA addresses for the ip-family annotation
+func (c *Controller) addresses(family string) []recordAddress {
+	return []recordAddress{
+		{"A", family == FamilyIPv4 || family == FamilyDual, c.currentIP.Get()},
+		{"AAAA", family == FamilyIPv6 || family == FamilyDual, c.currentIP.GetV6()},
+	}
+}
+
+//recordDeleted - Record an event for a deleted record
+func (c *Controller) recordDeleted(object runtime.Object, recordType, name string) {
+	if c.config.DryRun {
+		c.eventf(object, v1.EventTypeNormal, "DryRun", "Would delete %v record %v", recordType, name)
+		return
+	}
+	c.eventf(object, v1.EventTypeNormal, "RecordDeleted", "Deleted %v record %v", recordType, name)
+}
+
+//syncFailed - Record an event for an error that retrying won't fix, and keep the error to return
+//from the sync, preferring errors that will be retried
+func (c *Controller) syncFailed(object runtime.Object, syncErr, err error) error {
+	var conflict *OwnershipConflictError
+	if errors.As(err, &conflict) {
+		c.recorder.Eventf(object, v1.EventTypeWarning, "OwnershipConflict", "Not updating %v: %v", conflict.Name, err)
+	} else if isPermanent(err) {
+		c.recorder.Eventf(object, v1.EventTypeWarning, "CloudflareError", "%v", err)
+	}
+	if syncErr == nil || (isPermanent(syncErr) && !isPermanent(err)) {
+		return err
+	}
+	return syncErr
+}
+
 func (c *Controller) cloudflareSync(key string) error {
 	var obj interface{}
 	var exists bool
@@ -120,39 +306,227 @@ func (c *Controller) cloudflareSync(key string) error {
 
 	if !exists {
 		fmt.Printf("Service %s does not exist anymore\n", key)
-		c.cloudflareDeleteRecordPair(key)
+		err = c.cloudflareDeleteRecordPair(key)
 	} else {
-		var annotations map[string]string
-		if splitKey[0] == "service" {
-			annotations = obj.(*v1.Service).GetAnnotations()
-		} else {
-			annotations = obj.(*v1beta1.Ingress).GetAnnotations()
+		spec, ok := c.recordSpec(key, obj)
+		if !ok {
+			return nil
 		}
 
-		if _, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/hostname"]; !ok {
+		//Without hostnames, records left from an earlier version of the object are orphaned
+		if len(spec.Hostnames) == 0 {
 			fmt.Printf("Skipping: %v\n", key)
+			if !policyAllowsDelete(spec.Policy) {
+				return nil
+			}
+			if err := c.cloudflareDeleteDroppedRecords(key, spec.Object, spec.Hostnames); err != nil {
+				return c.syncFailed(spec.Object, nil, err)
+			}
 			return nil
 		}
-		hostname := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/hostname"]
 
-		//Check if proxied is provided, if so convert to bool
-		var proxied bool
-		if _, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/proxied"]; ok {
-			proxied, err = strconv.ParseBool(annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/proxied"])
-			if err != nil {
-				fmt.Printf("Could not convert cloudflare-dynamic-dns.alpha.kubernetes.io/proxied to bool for %v\n", key)
-				return nil
+		//Keep syncing the other hostnames when one fails, the key is requeued afterwards
+		var syncErr error
+		for _, hostname := range spec.Hostnames {
+			if err := c.cloudflareSyncRecordPair(key, hostname, spec); err != nil {
+				syncErr = c.syncFailed(spec.Object, syncErr, err)
+				continue
+			}
+			fmt.Printf("Sync/Add/Update %v, hostname: %v, ip: %v, ipv6: %v\n", key, hostname, c.currentIP.Get(), c.currentIP.GetV6())
+		}
+		if policyAllowsDelete(spec.Policy) {
+			if err := c.cloudflareDeleteDroppedRecords(key, spec.Object, spec.Hostnames); err != nil {
+				syncErr = c.syncFailed(spec.Object, syncErr, err)
+			}
+		}
+		err = syncErr
+	}
+
+	return err
+}
+
+//recordSpec - What a Service or Ingress asks to publish
+type recordSpec struct {
+	Object    runtime.Object
+	Hostnames []string
+	Family    string
+	Proxied   bool
+	Adopt     bool
+	Policy    string
+	//AnnotatedPolicy is the value of the policy annotation, empty without one. It is stored in the
+	//TXT records so it still applies once the object is deleted.
+	AnnotatedPolicy string
+}
+
+//recordSpec - Read the annotations of the object. Returns false if an annotation is invalid,
+//in which case the records of the object are left as they are.
+func (c *Controller) recordSpec(key string, obj interface{}) (recordSpec, bool) {
+	var annotations map[string]string
+	var object runtime.Object
+	var ingress *Ingress
+	if strings.HasPrefix(key, "service/") {
+		annotations = obj.(*v1.Service).GetAnnotations()
+		object = obj.(*v1.Service)
+	} else {
+		var ok bool
+		ingress, ok = ingressFromObject(obj)
+		if !ok {
+			klog.Errorf("Unexpected ingress type %T for %v", obj, key)
+			return recordSpec{}, false
+		}
+		annotations = ingress.Annotations
+		object = ingress.Object
+	}
+	hostnames, err := c.hostnames(key, object, annotations, ingress)
+	if err != nil {
+		fmt.Printf("Could not convert cloudflare-dynamic-dns.alpha.kubernetes.io/from-rules to bool for %v\n", key)
+		c.recorder.Eventf(object, v1.EventTypeWarning, "InvalidAnnotation", "cloudflare-dynamic-dns.alpha.kubernetes.io/from-rules must be true or false")
+		return recordSpec{}, false
+	}
+	spec := recordSpec{Object: object, Hostnames: hostnames}
+
+	//Check if proxied is provided, if so convert to bool
+	if _, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/proxied"]; ok {
+		spec.Proxied, err = strconv.ParseBool(annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/proxied"])
+		if err != nil {
+			fmt.Printf("Could not convert cloudflare-dynamic-dns.alpha.kubernetes.io/proxied to bool for %v\n", key)
+			c.recorder.Eventf(object, v1.EventTypeWarning, "InvalidAnnotation", "cloudflare-dynamic-dns.alpha.kubernetes.io/proxied must be true or false")
+			return recordSpec{}, false
+		}
+	}
+
+	//Check which address families to publish, IPv4 only by default
+	spec.Family = FamilyIPv4
+	if value, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/ip-family"]; ok {
+		spec.Family = strings.ToLower(value)
+		if spec.Family != FamilyIPv4 && spec.Family != FamilyIPv6 && spec.Family != FamilyDual {
+			fmt.Printf("cloudflare-dynamic-dns.alpha.kubernetes.io/ip-family must be ipv4, ipv6 or dual for %v\n", key)
+			c.recorder.Eventf(object, v1.EventTypeWarning, "InvalidAnnotation", "cloudflare-dynamic-dns.alpha.kubernetes.io/ip-family must be ipv4, ipv6 or dual")
+			return recordSpec{}, false
+		}
+	}
+
+	//Records that weren't created by a controller are only taken over when asked to
+	if _, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/adopt"]; ok {
+		spec.Adopt, err = strconv.ParseBool(annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/adopt"])
+		if err != nil {
+			fmt.Printf("Could not convert cloudflare-dynamic-dns.alpha.kubernetes.io/adopt to bool for %v\n", key)
+			c.recorder.Eventf(object, v1.EventTypeWarning, "InvalidAnnotation", "cloudflare-dynamic-dns.alpha.kubernetes.io/adopt must be true or false")
+			return recordSpec{}, false
+		}
+	}
+
+	//The policy annotation overrides the global sync policy
+	spec.AnnotatedPolicy, err = annotatedPolicy(annotations)
+	if err != nil {
+		fmt.Printf("cloudflare-dynamic-dns.alpha.kubernetes.io/policy is invalid for %v: %v\n", key, err)
+		c.recorder.Eventf(object, v1.EventTypeWarning, "InvalidAnnotation", "cloudflare-dynamic-dns.alpha.kubernetes.io/policy must be sync, upsert-only or create-only")
+		return recordSpec{}, false
+	}
+	spec.Policy = c.config.Policy
+	if spec.AnnotatedPolicy != "" {
+		spec.Policy = spec.AnnotatedPolicy
+	}
+
+	return spec, true
+}
+
+//hostnamesFromRules - Check if records should be published for the rule and TLS hosts of an Ingress
+func (c *Controller) hostnamesFromRules(annotations map[string]string) (bool, error) {
+	value, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/from-rules"]
+	if !ok {
+		return c.config.IngressHostsFromRules, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+//hostnames - The hostnames to publish for an object. The hostname annotation must be in a
+//managed zone, while hosts taken from Ingress rules are filtered to the managed zones. Returns
+//an error if the from-rules annotation is invalid.
+func (c *Controller) hostnames(key string, object runtime.Object, annotations map[string]string, ingress *Ingress) ([]string, error) {
+	hostnames := []string{}
+	if value, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/hostname"]; ok {
+		for _, hostname := range splitHostnames(value) {
+			if err := validateHostname(hostname); err != nil {
+				klog.Errorf("Skipping hostname of %v: %v", key, err)
+				c.recorder.Eventf(object, v1.EventTypeWarning, "InvalidAnnotation", "Skipping hostname: %v", err)
+				continue
+			}
+			//Retrying won't help if the hostname is outside of every managed zone
+			if err := c.provider.ManagesName(hostname); err != nil {
+				klog.Errorf("Skipping %v: %v", key, err)
+				c.recorder.Eventf(object, v1.EventTypeWarning, "ZoneNotManaged", "Hostname %v does not belong to any managed Cloudflare zone", hostname)
+				continue
 			}
+			hostnames = append(hostnames, hostname)
 		}
+	}
 
-		publicIP := c.currentIP.Get()
-		c.cloudflareSyncRecordPair(key, hostname, publicIP, proxied)
-		fmt.Printf("Sync/Add/Update %v, hostname: %v, ip: %v\n", key, hostname, publicIP)
+	if ingress == nil {
+		return hostnames, nil
+	}
+	fromRules, err := c.hostnamesFromRules(annotations)
+	if err != nil || !fromRules {
+		return hostnames, err
+	}
+	for _, host := range append(append([]string{}, ingress.RuleHosts...), ingress.TLSHosts...) {
+		host = normalizeHostname(host)
+		if host == "" || containsString(hostnames, host) {
+			continue
+		}
+		if err := c.provider.ManagesName(host); err != nil {
+			klog.V(2).Infof("Ignoring ingress host %v of %v: %v", host, key, err)
+			continue
+		}
+		hostnames = append(hostnames, host)
+	}
+	return hostnames, nil
+}
+
+//splitHostnames - Parse the comma separated hostname annotation, dropping empty and repeated names
+func splitHostnames(value string) []string {
+	hostnames := []string{}
+	for _, hostname := range strings.Split(value, ",") {
+		hostname = normalizeHostname(hostname)
+		if hostname != "" && !containsString(hostnames, hostname) {
+			hostnames = append(hostnames, hostname)
+		}
 	}
+	return hostnames
+}
+
+//normalizeHostname - Lower case the name without the trailing dot, as Cloudflare returns it
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+}
 
+//validateHostname - A wildcard is only allowed as the whole leftmost label, e.g. *.apps.example.com
+func validateHostname(hostname string) error {
+	if strings.Contains(strings.TrimPrefix(hostname, "*."), "*") {
+		return fmt.Errorf("%v is not a valid hostname, a wildcard must be the leftmost label", hostname)
+	}
 	return nil
 }
 
+//containsHostname - Check if the list has the name, ignoring case
+func containsHostname(hostnames []string, name string) bool {
+	for _, hostname := range hostnames {
+		if strings.EqualFold(hostname, strings.TrimSuffix(name, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // handleErr checks if an error happened and makes sure we will retry later.
 func (c *Controller) handleErr(err error, key interface{}) {
 	if err == nil {
@@ -163,6 +537,13 @@ func (c *Controller) handleErr(err error, key interface{}) {
 		return
 	}
 
+	//Retrying won't fix a permanent error, the event recorded on the object explains it
+	if isPermanent(err) {
+		c.queue.Forget(key)
+		klog.Errorf("Not retrying %v: %v", key, err)
+		return
+	}
+
 	// This controller retries 5 times if something goes wrong. After that, it stops trying.
 	if c.queue.NumRequeues(key) < 5 {
 		klog.Infof("Error syncing %v: %v", key, err)
@@ -175,12 +556,12 @@ func (c *Controller) handleErr(err error, key interface{}) {
 
 	c.queue.Forget(key)
 	// Report to an external entity that, even after several retries, we could not successfully process this key
-	runtime.HandleError(err)
+	utilruntime.HandleError(err)
 	klog.Infof("Dropping %q out of the queue: %v", key, err)
 }
 
 func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
-	defer runtime.HandleCrash()
+	defer utilruntime.HandleCrash()
 
 	// Let the workers stop when we are done
 	defer c.queue.ShutDown()
@@ -190,8 +571,8 @@ func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
 	go c.ingressInformer.Run(stopCh)
 
 	// Wait for all involved caches to be synced, before processing items from the queue is started
-	if !cache.WaitForCacheSync(stopCh, c.serviceInformer.HasSynced) {
-		runtime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
+	if !cache.WaitForCacheSync(stopCh, c.serviceInformer.HasSynced, c.ingressInformer.HasSynced) {
+		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
 	}
 
@@ -199,10 +580,67 @@ func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
 		go wait.Until(c.runWorker, time.Second, stopCh)
 	}
 
+	go c.watchIPChanges(stopCh)
+
+	//The collector must only see synced caches, otherwise every record looks orphaned
+	if c.config.GCInterval > 0 {
+		go wait.Until(func() { c.collectGarbage() }, c.config.GCInterval, stopCh)
+	}
+
 	<-stopCh
 	klog.Info("Stopping controller")
 }
 
+//watchIPChanges - Refresh every managed record as soon as the public IP changes
+func (c *Controller) watchIPChanges(stopCh chan struct{}) {
+	changes := c.currentIP.Subscribe()
+	for {
+		select {
+		case change := <-changes:
+			count := c.enqueueManaged()
+			klog.Infof("Public %v address changed from %q to %q, refreshing %d records", change.Family, change.Old, change.New, count)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+//enqueueManaged - Add every Service and Ingress that may have records to the queue
+func (c *Controller) enqueueManaged() int {
+	count := 0
+	for prefix, indexer := range map[string]cache.Indexer{"service/": c.serviceIndexer, "ingress/": c.ingressIndexer} {
+		for _, obj := range indexer.List() {
+			accessor, err := meta.Accessor(obj)
+			if err != nil {
+				continue
+			}
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				continue
+			}
+			if !c.wantsRecords(prefix+key, accessor.GetAnnotations()) {
+				continue
+			}
+			c.queue.Add(prefix + key)
+			count++
+		}
+	}
+	return count
+}
+
+//wantsRecords - Check if the object with the key and annotations may have records
+func (c *Controller) wantsRecords(key string, annotations map[string]string) bool {
+	if _, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/hostname"]; ok {
+		return true
+	}
+	if !strings.HasPrefix(key, "ingress/") {
+		return false
+	}
+	//An invalid from-rules annotation may still have records, which are kept until it is fixed
+	fromRules, err := c.hostnamesFromRules(annotations)
+	return fromRules || err != nil
+}
+
 func (c *Controller) runWorker() {
 	for c.processNextItem() {
 	}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+//newTestController - Controller backed by the provider with empty indexers and no informers
+func newTestController(provider DNSProvider, ip string) (*Controller, *record.FakeRecorder) {
+	currentIP := &CurrentIP{}
+	currentIP.Set(ip)
+	recorder := record.NewFakeRecorder(100)
+	serviceIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	ingressIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	return NewController(ControllerConfig{OwnerID: DefaultOwnerID, Policy: PolicySync}, currentIP, provider, recorder, queue, serviceIndexer, nil, ingressIndexer, nil), recorder
+}
+
+func newTestService(name string, annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestCloudflareSyncCreatesAndDeletesRecordPair(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "example.com", Content: "v=spf1 -all"})
+	controller, _ := newTestController(cf, "1.2.3.4")
+
+	service := newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/proxied":  "true",
+	})
+	controller.serviceIndexer.Add(service)
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+
+	want := []string{
+		"A web.example.com 1.2.3.4",
+		"TXT example.com v=spf1 -all",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after sync = %v, want %v", got, want)
+	}
+	if records := server.FindRecords("A", "web.example.com"); !records[0].Proxied {
+		t.Errorf("A record is not proxied")
+	}
+
+	//A new IP updates the A record in place
+	controller.currentIP.Set("5.6.7.8")
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if records := server.FindRecords("A", "web.example.com"); len(records) != 1 || records[0].Content != "5.6.7.8" {
+		t.Fatalf("A records after IP change = %+v", records)
+	}
+
+	controller.serviceIndexer.Delete(service)
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	want = []string{"TXT example.com v=spf1 -all"}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after delete = %v, want %v", got, want)
+	}
+}
+
+func TestCloudflareSyncDeleteKeepsOtherOwners(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	cf.PerPage = 1
+	controller, _ := newTestController(cf, "1.2.3.4")
+
+	for _, name := range []string{"a", "b", "c"} {
+		controller.serviceIndexer.Add(newTestService(name, map[string]string{
+			"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": name + ".example.com",
+		}))
+		if err := controller.cloudflareSync("service/default/" + name); err != nil {
+			t.Fatalf("cloudflareSync() error = %v", err)
+		}
+	}
+
+	//The owning TXT record for c is on the last page of results
+	controller.serviceIndexer.Delete(newTestService("c", nil))
+	if err := controller.cloudflareSync("service/default/c"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+
+	want := []string{
+		"A a.example.com 1.2.3.4",
+		"A b.example.com 1.2.3.4",
+		"TXT a.example.com heritage=cf-ddns,owner=default,resource=service/default/a",
+		"TXT b.example.com heritage=cf-ddns,owner=default,resource=service/default/b",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+}
+
+func TestCloudflareSyncMultipleHostnames(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	controller, _ := newTestController(cf, "1.2.3.4")
+
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com, *.apps.example.com,api.example.com,web.example.com,a*.example.com",
+	}))
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	want := []string{
+		"A *.apps.example.com 1.2.3.4",
+		"A api.example.com 1.2.3.4",
+		"A web.example.com 1.2.3.4",
+		"TXT *.apps.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+		"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after sync = %v, want %v", got, want)
+	}
+
+	//Names dropped from the list are removed, the rest are kept
+	controller.serviceIndexer.Update(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "WEB.example.com,*.apps.example.com",
+	}))
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	want = []string{
+		"A *.apps.example.com 1.2.3.4",
+		"A web.example.com 1.2.3.4",
+		"TXT *.apps.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after update = %v, want %v", got, want)
+	}
+}
+
+func TestCloudflareSyncRemovesOrphanedRecords(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	controller, _ := newTestController(cf, "1.2.3.4")
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "other.example.com", Content: "service/default/other"})
+
+	sync := func(annotations map[string]string) {
+		t.Helper()
+		controller.serviceIndexer.Update(newTestService("web", annotations))
+		if err := controller.cloudflareSync("service/default/web"); err != nil {
+			t.Fatalf("cloudflareSync() error = %v", err)
+		}
+	}
+
+	sync(map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "a.example.com"})
+	sync(map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "b.example.com"})
+	want := []string{
+		"A b.example.com 1.2.3.4",
+		"TXT b.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+		"TXT other.example.com service/default/other",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after rename = %v, want %v", got, want)
+	}
+
+	sync(nil)
+	want = []string{"TXT other.example.com service/default/other"}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after removing the annotation = %v, want %v", got, want)
+	}
+}
+
+func TestCloudflareSyncSkipsUnmanagedHostnames(t *testing.T) {
+	provider := NewMemoryProvider([]string{"example.com"})
+	controller, recorder := newTestController(provider, "1.2.3.4")
+
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.org",
+	}))
+	controller.serviceIndexer.Add(newTestService("plain", nil))
+	for _, key := range []string{"service/default/web", "service/default/plain"} {
+		if err := controller.cloudflareSync(key); err != nil {
+			t.Fatalf("cloudflareSync(%v) error = %v", key, err)
+		}
+	}
+
+	if records, _ := provider.ListRecords(RecordFilter{}); len(records) != 0 {
+		t.Errorf("records = %+v, want none", records)
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != "Warning ZoneNotManaged Hostname web.example.org does not belong to any managed Cloudflare zone" {
+			t.Errorf("event = %q", event)
+		}
+	default:
+		t.Error("no ZoneNotManaged event recorded")
+	}
+}
+
+func TestCloudflareSyncWithoutProxyingSupport(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	provider.Proxying = false
+	controller, _ := newTestController(provider, "1.2.3.4")
+
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/proxied":  "true",
+	}))
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+
+	record, err := provider.GetRecord("A", "web.example.com")
+	if err != nil || record.ID == "" || record.Proxied {
+		t.Errorf("A record = %+v, %v, want an unproxied record", record, err)
+	}
+}
+
+func TestEnqueueManaged(t *testing.T) {
+	controller, _ := newTestController(NewMemoryProvider(nil), "1.2.3.4")
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+	controller.serviceIndexer.Add(newTestService("plain", nil))
+
+	if count := controller.enqueueManaged(); count != 1 {
+		t.Fatalf("enqueueManaged() = %v, want 1", count)
+	}
+	if key, _ := controller.queue.Get(); key != "service/default/web" {
+		t.Errorf("queued key = %v", key)
+	}
+}
+
+func TestCloudflareSyncKeepsUnpublishedFamilies(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	controller, _ := newTestController(provider, "1.2.3.4")
+	for _, record := range []DNSRecord{
+		{RecordType: "TXT", Name: "web.example.com", Content: "service/default/web"},
+		{RecordType: "A", Name: "web.example.com", Content: "5.6.7.8"},
+		{RecordType: "AAAA", Name: "web.example.com", Content: "2001:db8::1"},
+		{RecordType: "TXT", Name: "api.example.com", Content: registryContent(DefaultOwnerID, "service/default/api", FamilyIPv6, "")},
+		{RecordType: "A", Name: "api.example.com", Content: "5.6.7.8"},
+		{RecordType: "AAAA", Name: "api.example.com", Content: "2001:db8::1"},
+	} {
+		provider.CreateRecord(record)
+	}
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+	api := newTestService("api", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname":  "api.example.com",
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/ip-family": "ipv6",
+	})
+	controller.serviceIndexer.Add(api)
+
+	//The AAAA record next to the A record of an ipv4 object was added by hand, and so was the A
+	//record next to the AAAA record of an ipv6 object. Both are kept after the sync and delete.
+	for _, key := range []string{"service/default/web", "service/default/api"} {
+		if err := controller.cloudflareSync(key); err != nil {
+			t.Fatalf("cloudflareSync(%v) error = %v", key, err)
+		}
+	}
+	if record, _ := provider.GetRecord("AAAA", "web.example.com"); record.Content != "2001:db8::1" {
+		t.Errorf("AAAA record of an ipv4 object = %+v", record)
+	}
+	if record, _ := provider.GetRecord("A", "api.example.com"); record.Content != "5.6.7.8" {
+		t.Errorf("A record of an ipv6 object = %+v", record)
+	}
+	controller.serviceIndexer.Delete(api)
+	if err := controller.cloudflareSync("service/default/api"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	records, _ := provider.ListRecords(RecordFilter{Name: "api.example.com"})
+	if len(records) != 1 || records[0].RecordType != "A" {
+		t.Errorf("records of a deleted ipv6 object = %+v, want the A record", records)
+	}
+}
+
+func TestCloudflareSyncIPFamilies(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	controller, _ := newTestController(provider, "1.2.3.4")
+	controller.currentIP.Set("2001:db8::1")
+	service := newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname":  "web.example.com",
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/ip-family": "dual",
+	})
+	controller.serviceIndexer.Add(service)
+
+	contents := func() []string {
+		records, _ := provider.ListRecords(RecordFilter{Name: "web.example.com"})
+		got := []string{}
+		for _, record := range records {
+			got = append(got, record.RecordType+" "+record.Content)
+		}
+		return got
+	}
+	sync := func() {
+		t.Helper()
+		if err := controller.cloudflareSync("service/default/web"); err != nil {
+			t.Fatalf("cloudflareSync() error = %v", err)
+		}
+	}
+
+	sync()
+	want := []string{"TXT heritage=cf-ddns,owner=default,resource=service/default/web,family=dual", "A 1.2.3.4", "AAAA 2001:db8::1"}
+	if got := contents(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("dual records = %v, want %v", got, want)
+	}
+
+	//Losing the IPv6 address removes the AAAA record
+	controller.currentIP.ClearV6()
+	sync()
+	want = []string{"TXT heritage=cf-ddns,owner=default,resource=service/default/web,family=dual", "A 1.2.3.4"}
+	if got := contents(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records without IPv6 = %v, want %v", got, want)
+	}
+
+	controller.currentIP.Set("2001:db8::2")
+	service.Annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/ip-family"] = "ipv6"
+	sync()
+	want = []string{"TXT heritage=cf-ddns,owner=default,resource=service/default/web,family=ipv6", "AAAA 2001:db8::2"}
+	if got := contents(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ipv6 records = %v, want %v", got, want)
+	}
+
+	controller.serviceIndexer.Delete(service)
+	sync()
+	if got := contents(); len(got) != 0 {
+		t.Fatalf("records after delete = %v", got)
+	}
+}
+
+func TestCloudflareSyncIngress(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	controller, _ := newTestController(provider, "1.2.3.4")
+	controller.ingressIndexer.Add(&networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com"},
+		},
+	})
+
+	if err := controller.cloudflareSync("ingress/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	record, err := provider.GetRecord("TXT", "web.example.com")
+	if err != nil || record.Content != registryContent(DefaultOwnerID, "ingress/default/web", "", "") {
+		t.Errorf("TXT record = %+v, %v", record, err)
+	}
+}
+
+func TestCloudflareSyncIngressHostsFromRules(t *testing.T) {
+	provider := NewMemoryProvider([]string{"example.com"})
+	controller, _ := newTestController(provider, "1.2.3.4")
+	controller.config.IngressHostsFromRules = true
+	controller.ingressIndexer.Add(&networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{Host: "www.example.com"}, {Host: ""}, {Host: "www.example.org"}},
+			TLS:   []networkingv1.IngressTLS{{Hosts: []string{"www.example.com", "api.example.com"}}},
+		},
+	})
+	controller.ingressIndexer.Add(&networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "opted-out",
+			Namespace:   "default",
+			Annotations: map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/from-rules": "false"},
+		},
+		Spec: networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{Host: "opted-out.example.com"}}},
+	})
+
+	if count := controller.enqueueManaged(); count != 1 {
+		t.Errorf("enqueueManaged() = %v, want 1", count)
+	}
+	for _, key := range []string{"ingress/default/web", "ingress/default/opted-out"} {
+		if err := controller.cloudflareSync(key); err != nil {
+			t.Fatalf("cloudflareSync(%v) error = %v", key, err)
+		}
+	}
+
+	records, _ := provider.ListRecords(RecordFilter{})
+	got := []string{}
+	for _, record := range records {
+		got = append(got, record.RecordType+" "+record.Name+" "+record.Content)
+	}
+	want := []string{
+		"TXT www.example.com heritage=cf-ddns,owner=default,resource=ingress/default/web",
+		"A www.example.com 1.2.3.4",
+		"TXT api.example.com heritage=cf-ddns,owner=default,resource=ingress/default/web",
+		"A api.example.com 1.2.3.4",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+
+	//An invalid from-rules annotation keeps the records until it is fixed
+	obj, _, _ := controller.ingressIndexer.GetByKey("default/web")
+	obj.(*networkingv1.Ingress).Annotations = map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/from-rules": "yes"}
+	if err := controller.cloudflareSync("ingress/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if orphans := controller.collectGarbage(); orphans != 0 {
+		t.Errorf("collectGarbage() = %v, want 0", orphans)
+	}
+	if records, _ := provider.ListRecords(RecordFilter{}); len(records) != len(want) {
+		t.Errorf("records after an invalid from-rules annotation = %+v", records)
+	}
+}
+
+func TestCloudflareSyncAdoptsUnmanagedRecords(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "www.example.com", Content: "9.9.9.9"})
+	controller, recorder := newTestController(cf, "1.2.3.4")
+
+	annotations := map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "www.example.com"}
+	controller.serviceIndexer.Add(newTestService("web", annotations))
+	if err := controller.cloudflareSync("service/default/web"); !isPermanent(err) {
+		t.Fatalf("cloudflareSync() error = %v, want a permanent error", err)
+	}
+	want := []string{"A www.example.com 9.9.9.9"}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records without adopt = %v, want %v", got, want)
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != "Warning OwnershipConflict Not updating www.example.com: www.example.com has a A record that is not managed by the controller, set the adopt annotation to take it over" {
+			t.Errorf("event = %q", event)
+		}
+	default:
+		t.Error("no OwnershipConflict event recorded")
+	}
+
+	annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/adopt"] = "true"
+	controller.serviceIndexer.Update(newTestService("web", annotations))
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	want = []string{
+		"A www.example.com 1.2.3.4",
+		"TXT www.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after adopting = %v, want %v", got, want)
+	}
+}
+
+//drainEvents - The events recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestCloudflareSyncRecordsEvents(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	controller, recorder := newTestController(cf, "1.2.3.4")
+
+	sync := func(annotations map[string]string) []string {
+		t.Helper()
+		controller.serviceIndexer.Update(newTestService("web", annotations))
+		if err := controller.cloudflareSync("service/default/web"); err != nil {
+			t.Fatalf("cloudflareSync() error = %v", err)
+		}
+		return drainEvents(recorder)
+	}
+
+	annotations := map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com"}
+	want := []string{
+		"Normal RecordCreated Created TXT record web.example.com with heritage=cf-ddns,owner=default,resource=service/default/web",
+		"Normal RecordCreated Created A record web.example.com with 1.2.3.4",
+	}
+	if got := sync(annotations); !reflect.DeepEqual(got, want) {
+		t.Errorf("events after create = %v, want %v", got, want)
+	}
+
+	controller.currentIP.Set("5.6.7.8")
+	want = []string{"Normal RecordUpdated Updated A record web.example.com to 5.6.7.8"}
+	if got := sync(annotations); !reflect.DeepEqual(got, want) {
+		t.Errorf("events after update = %v, want %v", got, want)
+	}
+
+	annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/proxied"] = "maybe"
+	want = []string{"Warning InvalidAnnotation cloudflare-dynamic-dns.alpha.kubernetes.io/proxied must be true or false"}
+	if got := sync(annotations); !reflect.DeepEqual(got, want) {
+		t.Errorf("events with an invalid annotation = %v, want %v", got, want)
+	}
+
+	//Only errors that won't be retried are recorded
+	delete(annotations, "cloudflare-dynamic-dns.alpha.kubernetes.io/proxied")
+	controller.serviceIndexer.Update(newTestService("web", annotations))
+	server.FailNext(http.StatusInternalServerError, 1000, "Internal error")
+	if err := controller.cloudflareSync("service/default/web"); err == nil || isPermanent(err) {
+		t.Errorf("cloudflareSync() error = %v, want a retryable error", err)
+	}
+	if got := drainEvents(recorder); len(got) != 0 {
+		t.Errorf("events after a retryable error = %v", got)
+	}
+	server.FailNext(http.StatusBadRequest, 9005, "Content for A record is invalid")
+	if err := controller.cloudflareSync("service/default/web"); !isPermanent(err) {
+		t.Errorf("cloudflareSync() error = %v, want a permanent error", err)
+	}
+	want = []string{"Warning CloudflareError Failed to sync TXT record of web.example.com: Error code 9005, Content for A record is invalid."}
+	if got := drainEvents(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events after a permanent error = %v, want %v", got, want)
+	}
+
+	want = []string{
+		"Normal RecordDeleted Deleted A record web.example.com",
+		"Normal RecordDeleted Deleted TXT record web.example.com",
+	}
+	if got := sync(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("events after removing the annotation = %v, want %v", got, want)
+	}
+}
+
+func TestHandleErrRetriesOnlyRetryableErrors(t *testing.T) {
+	controller, _ := newTestController(NewMemoryProvider(nil), "1.2.3.4")
+
+	controller.handleErr(&RetryableError{Err: errors.New("rate limited")}, "service/default/web")
+	if requeues := controller.queue.NumRequeues("service/default/web"); requeues != 1 {
+		t.Errorf("NumRequeues() after a retryable error = %v, want 1", requeues)
+	}
+
+	controller.handleErr(&PermanentError{Err: errors.New("invalid record")}, "service/default/web")
+	if requeues := controller.queue.NumRequeues("service/default/web"); requeues != 0 {
+		t.Errorf("NumRequeues() after a permanent error = %v, want 0", requeues)
+	}
+}
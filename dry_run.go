@@ -0,0 +1,58 @@
+package main
+
+import (
+	"k8s.io/klog"
+)
+
+//DryRunProvider - DNSProvider that reads the records of the wrapped provider but only logs the
+//changes it is asked to make, so the controller can be tried against a production zone
+type DryRunProvider struct {
+	Provider DNSProvider
+}
+
+var _ DNSProvider = &DryRunProvider{}
+
+func NewDryRunProvider(provider DNSProvider) *DryRunProvider {
+	return &DryRunProvider{Provider: provider}
+}
+
+//logChange - Log a change as key=value pairs so the log can be searched and parsed
+func (p *DryRunProvider) logChange(action string, record DNSRecord) {
+	klog.Infof("Dry run: action=%v type=%v name=%q content=%q ttl=%v proxied=%v id=%q",
+		action, record.RecordType, record.Name, record.Content, record.TTL, record.Proxied, record.ID)
+}
+
+func (p *DryRunProvider) ManagesName(name string) error {
+	return p.Provider.ManagesName(name)
+}
+
+func (p *DryRunProvider) Capabilities() ProviderCapabilities {
+	return p.Provider.Capabilities()
+}
+
+func (p *DryRunProvider) ListRecords(filter RecordFilter) ([]DNSRecord, error) {
+	return p.Provider.ListRecords(filter)
+}
+
+func (p *DryRunProvider) GetRecord(recordType, name string) (DNSRecord, error) {
+	return p.Provider.GetRecord(recordType, name)
+}
+
+//CreateRecord - Log the record, it still fails for names outside the managed zones like a real create
+func (p *DryRunProvider) CreateRecord(record DNSRecord) (DNSRecord, error) {
+	if err := p.Provider.ManagesName(record.Name); err != nil {
+		return DNSRecord{}, err
+	}
+	p.logChange("create", record)
+	return record, nil
+}
+
+func (p *DryRunProvider) UpdateRecord(record DNSRecord) (DNSRecord, error) {
+	p.logChange("update", record)
+	return record, nil
+}
+
+func (p *DryRunProvider) DeleteRecord(record DNSRecord) error {
+	p.logChange("delete", record)
+	return nil
+}
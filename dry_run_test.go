@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+)
+
+func TestDryRunOnlyReads(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "web.example.com", Content: "5.6.7.8"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "web.example.com", Content: "service/default/web"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "old.example.com", Content: "service/default/old"})
+	before := cloudflaretest.RecordStrings(server.Records(""))
+
+	controller, recorder := newTestController(NewDryRunProvider(cf), "1.2.3.4")
+	controller.config.DryRun = true
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+	server.ResetRequests()
+
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if err := controller.cloudflareSync("service/default/old"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, before) {
+		t.Errorf("records after a dry run = %v, want %v", got, before)
+	}
+	for _, request := range server.Requests() {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Errorf("dry run made request %v", request)
+		}
+	}
+
+	want := []string{
+		"Normal DryRun Would update TXT record web.example.com to heritage=cf-ddns,owner=default,resource=service/default/web",
+		"Normal DryRun Would update A record web.example.com to 1.2.3.4",
+	}
+	if got := drainEvents(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	//Names outside the managed zones fail like they would without a dry run
+	if _, err := NewDryRunProvider(cf).CreateRecord(DNSRecord{RecordType: "A", Name: "web.example.org", Content: "1.2.3.4"}); err == nil {
+		t.Error("CreateRecord() outside the managed zones succeeded")
+	}
+}
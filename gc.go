@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/klog"
+)
+
+//ownerAnnotations - The annotations of the object owning a TXT registry record, exists is false
+//if it was deleted
+func (c *Controller) ownerAnnotations(key string) (annotations map[string]string, exists bool, err error) {
+	splitKey := strings.Split(key, "/")
+	indexer := c.serviceIndexer
+	if splitKey[0] == "ingress" {
+		indexer = c.ingressIndexer
+	}
+
+	obj, exists, err := indexer.GetByKey(splitKey[1] + "/" + splitKey[2])
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return accessor.GetAnnotations(), true, nil
+}
+
+//ownerExists - Check the object owning a TXT registry record still exists and wants records
+func (c *Controller) ownerExists(key string) (bool, error) {
+	annotations, exists, err := c.ownerAnnotations(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	return c.wantsRecords(key, annotations), nil
+}
+
+//ownerPolicy - The sync policy for the orphaned records of a TXT registry record. An object that
+//still exists but no longer wants the records uses its policy annotation, a deleted object the
+//policy stored in the TXT record. Both fall back to the global policy.
+func (c *Controller) ownerPolicy(entry registryEntry) (string, error) {
+	annotations, exists, err := c.ownerAnnotations(entry.Resource)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return c.registryPolicy(entry), nil
+	}
+	policy, err := annotatedPolicy(annotations)
+	if err != nil || policy == "" {
+		return c.config.Policy, err
+	}
+	return policy, nil
+}
+
+//collectGarbage - Delete the records of objects that were deleted or lost their annotations
+//while the controller wasn't watching. Returns the number of orphaned names found. Nothing is
+//deleted unless the policy of the owner allows deletes.
+func (c *Controller) collectGarbage() int {
+	records, err := c.provider.ListRecords(RecordFilter{RecordType: "TXT"})
+	if err != nil {
+		klog.Errorf("Garbage collection failed to list TXT records: %v", err)
+		return 0
+	}
+
+	orphans := 0
+	for _, record := range records {
+		//Records of other clusters are left alone, as are legacy records since they may be too
+		entry, ok := parseRegistryContent(record.Content)
+		if !ok || !entry.ownedBy(c.config.OwnerID) {
+			continue
+		}
+		exists, err := c.ownerExists(entry.Resource)
+		if err != nil {
+			klog.Errorf("Garbage collection skipped %v: %v", record.Name, err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		orphans++
+		policy, err := c.ownerPolicy(entry)
+		if err != nil {
+			klog.Errorf("Garbage collection skipped %v: %v", record.Name, err)
+			continue
+		}
+		if !policyAllowsDelete(policy) {
+			klog.Infof("Garbage collection keeping the records of %v owned by %v with the %v policy", record.Name, entry.Resource, policy)
+			continue
+		}
+		if c.config.GCDryRun {
+			klog.Infof("Garbage collection would delete the records of %v owned by %v", record.Name, entry.Resource)
+			continue
+		}
+		fmt.Printf("Garbage collection deleting the records of %v owned by %v\n", record.Name, entry.Resource)
+		if err := c.deleteOwnedRecords(nil, record); err != nil {
+			klog.Errorf("Garbage collection failed to delete the records of %v: %v", record.Name, err)
+		}
+	}
+	klog.Infof("Garbage collection found %d orphaned names", orphans)
+	return orphans
+}
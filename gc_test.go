@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	controller, _ := newTestController(provider, "1.2.3.4")
+	controller.config.GCDryRun = true
+	controller.serviceIndexer.Add(newTestService("kept", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "kept.example.com",
+	}))
+	controller.serviceIndexer.Add(newTestService("plain", nil))
+
+	for _, record := range []DNSRecord{
+		{RecordType: "TXT", Name: "kept.example.com", Content: "service/default/kept"},
+		{RecordType: "A", Name: "kept.example.com", Content: "1.2.3.4"},
+		{RecordType: "TXT", Name: "plain.example.com", Content: registryContent(DefaultOwnerID, "service/default/plain", "", "")},
+		{RecordType: "A", Name: "plain.example.com", Content: "1.2.3.4"},
+		{RecordType: "TXT", Name: "gone.example.com", Content: registryContent(DefaultOwnerID, "ingress/default/gone", FamilyIPv6, "")},
+		{RecordType: "AAAA", Name: "gone.example.com", Content: "2001:db8::1"},
+		{RecordType: "TXT", Name: "prod.example.com", Content: registryContent("prod", "service/default/gone", "", "")},
+		{RecordType: "TXT", Name: "legacy.example.com", Content: "service/prod/web"},
+		{RecordType: "A", Name: "legacy.example.com", Content: "1.2.3.4"},
+		{RecordType: "TXT", Name: "example.com", Content: "v=spf1 -all"},
+	} {
+		if _, err := provider.CreateRecord(record); err != nil {
+			t.Fatalf("CreateRecord() error = %v", err)
+		}
+	}
+
+	if orphans := controller.collectGarbage(); orphans != 2 {
+		t.Errorf("dry run collectGarbage() = %v, want 2", orphans)
+	}
+	if records, _ := provider.ListRecords(RecordFilter{}); len(records) != 10 {
+		t.Errorf("dry run deleted records, %d left", len(records))
+	}
+
+	controller.config.GCDryRun = false
+	if orphans := controller.collectGarbage(); orphans != 2 {
+		t.Errorf("collectGarbage() = %v, want 2", orphans)
+	}
+	records, _ := provider.ListRecords(RecordFilter{})
+	got := []string{}
+	for _, record := range records {
+		got = append(got, record.RecordType+" "+record.Name+" "+record.Content)
+	}
+	want := []string{
+		"TXT kept.example.com service/default/kept",
+		"A kept.example.com 1.2.3.4",
+		"TXT prod.example.com heritage=cf-ddns,owner=prod,resource=service/default/gone",
+		"TXT legacy.example.com service/prod/web",
+		"A legacy.example.com 1.2.3.4",
+		"TXT example.com v=spf1 -all",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
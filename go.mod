@@ -1,10 +1,10 @@
 module cloudflare_dynamic_dns_controller
 
-go 1.13
+go 1.15
 
 require (
-	k8s.io/api v0.17.0
-	k8s.io/apimachinery v0.17.0
-	k8s.io/client-go v0.17.0
+	k8s.io/api v0.20.15
+	k8s.io/apimachinery v0.20.15
+	k8s.io/client-go v0.20.15
 	k8s.io/klog v1.0.0
 )
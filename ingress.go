@@ -0,0 +1,84 @@
+package main
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+	v1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+//Ingress - Version neutral view of the Ingress fields the controller uses. Object is the
+//original Ingress, used for recording events.
+type Ingress struct {
+	Object      runtime.Object
+	Annotations map[string]string
+	RuleHosts   []string
+	TLSHosts    []string
+}
+
+//ingressFromObject - Convert a networking.k8s.io/v1 or v1beta1 Ingress
+func ingressFromObject(obj interface{}) (*Ingress, bool) {
+	ingress := &Ingress{}
+	switch i := obj.(type) {
+	case *networkingv1.Ingress:
+		ingress.Object = i
+		ingress.Annotations = i.GetAnnotations()
+		for _, rule := range i.Spec.Rules {
+			ingress.RuleHosts = append(ingress.RuleHosts, rule.Host)
+		}
+		for _, tls := range i.Spec.TLS {
+			ingress.TLSHosts = append(ingress.TLSHosts, tls.Hosts...)
+		}
+	case *v1beta1.Ingress:
+		ingress.Object = i
+		ingress.Annotations = i.GetAnnotations()
+		for _, rule := range i.Spec.Rules {
+			ingress.RuleHosts = append(ingress.RuleHosts, rule.Host)
+		}
+		for _, tls := range i.Spec.TLS {
+			ingress.TLSHosts = append(ingress.TLSHosts, tls.Hosts...)
+		}
+	default:
+		return nil, false
+	}
+	return ingress, true
+}
+
+//ingressAPIVersion - networking.k8s.io/v1 if the cluster serves Ingresses in it, v1beta1 on
+//clusters older than 1.19. Other discovery errors are returned rather than guessing, since
+//watching an API the cluster no longer serves would never sync.
+func ingressAPIVersion(client discovery.DiscoveryInterface) (string, error) {
+	resources, err := client.ServerResourcesForGroupVersion(networkingv1.SchemeGroupVersion.String())
+	if apierrors.IsNotFound(err) {
+		return v1beta1.SchemeGroupVersion.String(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == "ingresses" {
+			return networkingv1.SchemeGroupVersion.String(), nil
+		}
+	}
+	return v1beta1.SchemeGroupVersion.String(), nil
+}
+
+//newIngressListWatcher - Watch networking.k8s.io/v1 Ingresses if the cluster serves them,
+//falling back to v1beta1 on clusters older than 1.19
+func newIngressListWatcher(clientset kubernetes.Interface) (cache.ListerWatcher, runtime.Object, string, error) {
+	version, err := ingressAPIVersion(clientset.Discovery())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if version == networkingv1.SchemeGroupVersion.String() {
+		return cache.NewListWatchFromClient(clientset.NetworkingV1().RESTClient(), "ingresses", "", fields.Everything()),
+			&networkingv1.Ingress{}, version, nil
+	}
+
+	return cache.NewListWatchFromClient(clientset.NetworkingV1beta1().RESTClient(), "ingresses", "", fields.Everything()),
+		&v1beta1.Ingress{}, version, nil
+}
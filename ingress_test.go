@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	v1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestIngressFromObject(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{"a": "b"}}
+	objects := []interface{}{
+		&networkingv1.Ingress{
+			ObjectMeta: meta,
+			Spec: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{{Host: "www.example.com"}, {Host: "api.example.com"}},
+				TLS:   []networkingv1.IngressTLS{{Hosts: []string{"www.example.com"}}},
+			},
+		},
+		&v1beta1.Ingress{
+			ObjectMeta: meta,
+			Spec: v1beta1.IngressSpec{
+				Rules: []v1beta1.IngressRule{{Host: "www.example.com"}, {Host: "api.example.com"}},
+				TLS:   []v1beta1.IngressTLS{{Hosts: []string{"www.example.com"}}},
+			},
+		},
+	}
+	for _, obj := range objects {
+		ingress, ok := ingressFromObject(obj)
+		if !ok {
+			t.Fatalf("ingressFromObject(%T) failed", obj)
+		}
+		if ingress.Object != obj || ingress.Annotations["a"] != "b" {
+			t.Errorf("ingressFromObject(%T) = %+v", obj, ingress)
+		}
+		if !reflect.DeepEqual(ingress.RuleHosts, []string{"www.example.com", "api.example.com"}) ||
+			!reflect.DeepEqual(ingress.TLSHosts, []string{"www.example.com"}) {
+			t.Errorf("ingressFromObject(%T) hosts = %v, %v", obj, ingress.RuleHosts, ingress.TLSHosts)
+		}
+	}
+
+	if _, ok := ingressFromObject(&metav1.Status{}); ok {
+		t.Error("ingressFromObject() of another type succeeded")
+	}
+}
+
+func TestNewIngressListWatcher(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "networking.k8s.io/v1",
+		APIResources: []metav1.APIResource{{Name: "ingresses", Kind: "Ingress"}},
+	}}
+	if _, obj, version, err := newIngressListWatcher(clientset); err != nil || version != "networking.k8s.io/v1" {
+		t.Errorf("new cluster watches %v (%T), error = %v", version, obj, err)
+	}
+}
+
+func TestIngressAPIVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "v1", status: http.StatusOK, body: `{"groupVersion":"networking.k8s.io/v1","resources":[{"name":"ingresses","kind":"Ingress"}]}`, want: "networking.k8s.io/v1"},
+		{name: "v1 without ingresses", status: http.StatusOK, body: `{"groupVersion":"networking.k8s.io/v1","resources":[{"name":"networkpolicies","kind":"NetworkPolicy"}]}`, want: "networking.k8s.io/v1beta1"},
+		{name: "group version not found", status: http.StatusNotFound, body: "404 page not found", want: "networking.k8s.io/v1beta1"},
+		{name: "discovery error", status: http.StatusForbidden, body: "forbidden", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := discovery.NewDiscoveryClientForConfigOrDie(&rest.Config{Host: server.URL})
+			got, err := ingressAPIVersion(client)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ingressAPIVersion() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
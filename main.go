@@ -1,16 +1,23 @@
 package main
 
 import (
+	"flag"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/networking/v1beta1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
 )
 
 func homeDir() string {
@@ -20,7 +27,22 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
+//splitList - Split a comma separated list, dropping empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func main() {
+	dryRun := flag.Bool("dry-run", false, "Read the DNS records but only log the changes instead of making them")
+	flag.Parse()
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		panic(err.Error())
@@ -53,10 +75,26 @@ func main() {
 
 	// create the watchers
 	serviceListWatcher := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "services", "", fields.Everything())
-	ingressListWatcher := cache.NewListWatchFromClient(clientset.NetworkingV1beta1().RESTClient(), "ingresses", "", fields.Everything())
+	//The pod is restarted if discovery fails, rather than watching an Ingress API that may not exist
+	ingressListWatcher, ingressObject, ingressVersion, err := newIngressListWatcher(clientset)
+	if err != nil {
+		klog.Fatalf("Could not discover the Ingress API version: %v", err)
+	}
+	klog.Infof("Watching %v Ingresses", ingressVersion)
 
-	// create the workqueue
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	reconcileMode := ReconcileRecord
+	if mode := os.Getenv("RECONCILE_MODE"); mode != "" {
+		reconcileMode = mode
+	}
+	if reconcileMode != ReconcileRecord && reconcileMode != ReconcilePlan {
+		klog.Fatalf("Unknown RECONCILE_MODE %v", reconcileMode)
+	}
+
+	// create the workqueue, in plan mode every key is collapsed onto a single reconcile
+	var queue workqueue.RateLimitingInterface = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	if reconcileMode == ReconcilePlan {
+		queue = planQueue{queue}
+	}
 
 	serviceIndexer, serviceInformer := cache.NewIndexerInformer(serviceListWatcher, &v1.Service{}, 60*time.Second, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -81,7 +119,7 @@ func main() {
 		},
 	}, cache.Indexers{})
 
-	ingressIndexer, ingressInformer := cache.NewIndexerInformer(ingressListWatcher, &v1beta1.Ingress{}, 60*time.Second, cache.ResourceEventHandlerFuncs{
+	ingressIndexer, ingressInformer := cache.NewIndexerInformer(ingressListWatcher, ingressObject, 60*time.Second, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			if err == nil {
@@ -106,15 +144,206 @@ func main() {
 
 	cfAuthEmail := os.Getenv("CF_AUTH_EMAIL")
 	cfAuthToken := os.Getenv("CF_AUTH_TOKEN")
-	cfZoneID := os.Getenv("CF_ZONE_ID")
-	cf := NewCloudflare(cfAuthEmail, cfAuthToken, cfZoneID)
+	cfAPIToken := os.Getenv("CF_API_TOKEN")
+	//CF_ZONES is a comma separated list of zone IDs or names, CF_ZONE_ID is kept for
+	//existing deployments. If neither is set every zone the credentials can access is managed.
+	cfZones := splitList(os.Getenv("CF_ZONES"))
+	if cfZoneID := os.Getenv("CF_ZONE_ID"); cfZoneID != "" {
+		cfZones = append(cfZones, cfZoneID)
+	}
+	cfPerPage := 0
+	if perPage := os.Getenv("CF_PER_PAGE"); perPage != "" {
+		cfPerPage, err = strconv.Atoi(perPage)
+		if err != nil {
+			klog.Fatalf("Could not convert CF_PER_PAGE to an int: %v", err)
+		}
+	}
+
+	//DNS_PROVIDER=memory keeps records in memory instead of writing to Cloudflare
+	var provider DNSProvider
+	gauges := []Gauge{}
+	switch os.Getenv("DNS_PROVIDER") {
+	case "", "cloudflare":
+		cf := NewCloudflare(cfAuthEmail, cfAuthToken, cfAPIToken, cfZones, cfPerPage)
+		if baseURL := os.Getenv("CF_API_BASE_URL"); baseURL != "" {
+			cf.BaseURL = baseURL
+		}
+		if timeout := os.Getenv("CF_API_TIMEOUT"); timeout != "" {
+			cf.HTTPClient.Timeout, err = time.ParseDuration(timeout)
+			if err != nil {
+				klog.Fatalf("Could not convert CF_API_TIMEOUT to a duration: %v", err)
+			}
+		}
+		//CF_RATE_LIMIT is the number of requests allowed per 5 minutes, 0 disables the limiter
+		if rateLimit := os.Getenv("CF_RATE_LIMIT"); rateLimit != "" {
+			limit, err := strconv.Atoi(rateLimit)
+			if err != nil {
+				klog.Fatalf("Could not convert CF_RATE_LIMIT to an int: %v", err)
+			}
+			cf.Limiter = nil
+			if limit > 0 {
+				cf.Limiter = NewRateLimiter(limit, 5*time.Minute)
+			}
+		}
+		if cf.Limiter != nil {
+			gauges = append(gauges,
+				Gauge{Name: "cloudflare_api_rate_limit", Help: "Cloudflare API requests allowed per 5 minutes.", Value: func() float64 { return float64(cf.Limiter.Limit) }},
+				Gauge{Name: "cloudflare_api_rate_limit_tokens", Help: "Cloudflare API requests that can be made right away.", Value: cf.Limiter.Tokens},
+			)
+		}
+
+		//Fail fast if the credentials can't be used to manage records in the zones
+		if err := cf.Verify(); err != nil {
+			klog.Fatalf("Cloudflare credential check failed: %v", err)
+		}
+		if err := cf.LoadZones(); err != nil {
+			klog.Fatalf("Could not load Cloudflare zones: %v", err)
+		}
+		for _, zone := range cf.Zones {
+			klog.Infof("Managing Cloudflare zone %v (%v)", zone.Name, zone.ID)
+		}
+		provider = cf
+
+		//CF_CACHE_INTERVAL is how often the snapshot of every record is listed again, 0 disables it
+		cacheInterval := 5 * time.Minute
+		if interval := os.Getenv("CF_CACHE_INTERVAL"); interval != "" {
+			cacheInterval, err = time.ParseDuration(interval)
+			if err != nil {
+				klog.Fatalf("Could not convert CF_CACHE_INTERVAL to a duration: %v", err)
+			}
+		}
+		if cacheInterval > 0 {
+			provider = NewCachedProvider(cf, cacheInterval)
+		}
+	case "memory":
+		klog.Info("Using the in-memory DNS provider, no records will be written to Cloudflare")
+		provider = NewMemoryProvider(cfZones)
+	default:
+		klog.Fatalf("Unknown DNS_PROVIDER %v", os.Getenv("DNS_PROVIDER"))
+	}
+
+	//Reads still go to the provider so the logged changes are the ones that would be made
+	if *dryRun {
+		klog.Info("Dry run, DNS changes will be logged instead of made")
+		provider = NewDryRunProvider(provider)
+	}
+
+	//METRICS_ADDRESS serves the metrics in the Prometheus text format, e.g. :8080
+	if metricsAddress := os.Getenv("METRICS_ADDRESS"); metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler(gauges))
+		go func() {
+			klog.Fatal(http.ListenAndServe(metricsAddress, mux))
+		}()
+	}
+
+	//Events are recorded on the Service or Ingress so users can see why a record was not created
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "cloudflare-dynamic-dns-controller"})
+
+	//IP_SOURCES is a comma separated list of built in sources or URLs, and
+	//IP_SOURCE_STRATEGY decides how their answers are combined.
+	ipSources := []PublicIPSource{}
+	ipSourceSpecs := splitList(os.Getenv("IP_SOURCES"))
+	if len(ipSourceSpecs) == 0 {
+		ipSourceSpecs = []string{"ipify", "icanhazip", "cloudflare"}
+	}
+	for _, spec := range ipSourceSpecs {
+		source, err := NewPublicIPSource(spec)
+		if err != nil {
+			klog.Fatalf("Invalid IP_SOURCES: %v", err)
+		}
+		ipSources = append(ipSources, source)
+	}
+	ipStrategy := os.Getenv("IP_SOURCE_STRATEGY")
+	if ipStrategy == "" {
+		ipStrategy = StrategyMajority
+	}
+	detector, err := NewPublicIPDetector(ipSources, ipStrategy, FamilyIPv4)
+	if err != nil {
+		klog.Fatalf("Could not create public IP detector: %v", err)
+	}
+
+	//IPv6 detection is opt in since it fails on every check on networks without IPv6
+	var detector6 *PublicIPDetector
+	if ipv6 := os.Getenv("IPV6_ENABLED"); ipv6 != "" {
+		enabled, err := strconv.ParseBool(ipv6)
+		if err != nil {
+			klog.Fatalf("Could not convert IPV6_ENABLED to bool: %v", err)
+		}
+		if enabled {
+			detector6, err = NewPublicIPDetector(ipSources, ipStrategy, FamilyIPv6)
+			if err != nil {
+				klog.Fatalf("Could not create public IPv6 detector: %v", err)
+			}
+		}
+	}
 
 	//Start the public ip watcher and wait until we get an IP
 	currentIP := CurrentIP{}
-	go watchPublicIP(&currentIP)
+	if allowPrivate := os.Getenv("ALLOW_PRIVATE_IP"); allowPrivate != "" {
+		currentIP.AllowPrivate, err = strconv.ParseBool(allowPrivate)
+		if err != nil {
+			klog.Fatalf("Could not convert ALLOW_PRIVATE_IP to bool: %v", err)
+		}
+	}
+	go watchPublicIP(&currentIP, detector, detector6)
 	waitForPublicIP(&currentIP)
 
-	controller := NewController(&currentIP, cf, queue, serviceIndexer, serviceInformer, ingressIndexer, ingressInformer)
+	//INGRESS_HOSTS_FROM_RULES publishes the rule and TLS hosts of every Ingress
+	controllerConfig := ControllerConfig{DryRun: *dryRun}
+	if fromRules := os.Getenv("INGRESS_HOSTS_FROM_RULES"); fromRules != "" {
+		controllerConfig.IngressHostsFromRules, err = strconv.ParseBool(fromRules)
+		if err != nil {
+			klog.Fatalf("Could not convert INGRESS_HOSTS_FROM_RULES to bool: %v", err)
+		}
+	}
+
+	//GC_INTERVAL is how often records of deleted objects are collected, GC_DRY_RUN only reports them
+	controllerConfig.GCInterval = time.Hour
+	if interval := os.Getenv("GC_INTERVAL"); interval != "" {
+		controllerConfig.GCInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			klog.Fatalf("Could not convert GC_INTERVAL to a duration: %v", err)
+		}
+	}
+	if dryRun := os.Getenv("GC_DRY_RUN"); dryRun != "" {
+		controllerConfig.GCDryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			klog.Fatalf("Could not convert GC_DRY_RUN to bool: %v", err)
+		}
+	}
+
+	//OWNER_ID tells the records of controllers in different clusters sharing a zone apart
+	controllerConfig.OwnerID = DefaultOwnerID
+	if ownerID := os.Getenv("OWNER_ID"); ownerID != "" {
+		controllerConfig.OwnerID = ownerID
+	}
+	if err := validateOwnerID(controllerConfig.OwnerID); err != nil {
+		klog.Fatalf("Invalid OWNER_ID: %v", err)
+	}
+
+	//TXT_PREFIX and TXT_SUFFIX move the TXT records away from the names of the A records
+	controllerConfig.RegistryPrefix = os.Getenv("TXT_PREFIX")
+	controllerConfig.RegistrySuffix = os.Getenv("TXT_SUFFIX")
+	if err := validateRegistryAffixes(controllerConfig.RegistryPrefix, controllerConfig.RegistrySuffix); err != nil {
+		klog.Fatalf("Invalid TXT_PREFIX or TXT_SUFFIX: %v", err)
+	}
+
+	//SYNC_POLICY can be overridden per object with the policy annotation
+	controllerConfig.Policy = PolicySync
+	if policy := os.Getenv("SYNC_POLICY"); policy != "" {
+		controllerConfig.Policy = strings.ToLower(policy)
+	}
+	if err := validatePolicy(controllerConfig.Policy); err != nil {
+		klog.Fatalf("Invalid SYNC_POLICY: %v", err)
+	}
+
+	controllerConfig.ReconcileMode = reconcileMode
+
+	controller := NewController(controllerConfig, &currentIP, provider, recorder, queue, serviceIndexer, serviceInformer, ingressIndexer, ingressInformer)
 
 	// Now let's start the controller
 	stop := make(chan struct{})
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//MemoryProvider - DNSProvider that keeps records in memory, used for tests and dry runs.
+//When Zones is empty every name is managed.
+type MemoryProvider struct {
+	Zones    []string
+	Proxying bool
+	records  map[string]DNSRecord
+	nextID   int
+	mux      sync.Mutex
+}
+
+var _ DNSProvider = &MemoryProvider{}
+
+func NewMemoryProvider(zones []string) *MemoryProvider {
+	return &MemoryProvider{
+		Zones:    zones,
+		Proxying: true,
+		records:  map[string]DNSRecord{},
+	}
+}
+
+//ManagesName - Check the name belongs to one of the zones
+func (m *MemoryProvider) ManagesName(name string) error {
+	if len(m.Zones) == 0 {
+		return nil
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, zone := range m.Zones {
+		zone = strings.ToLower(zone)
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return nil
+		}
+	}
+	return &ZoneNotManagedError{Name: name}
+}
+
+//Capabilities - Proxying support can be toggled to mimic other providers
+func (m *MemoryProvider) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{SupportsProxying: m.Proxying}
+}
+
+//ListRecords - List all records matching the filter, ordered by creation
+func (m *MemoryProvider) ListRecords(filter RecordFilter) ([]DNSRecord, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	records := []DNSRecord{}
+	for i := 1; i <= m.nextID; i++ {
+		record, ok := m.records[strconv.Itoa(i)]
+		if ok && filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+//GetRecord - Get the first record with the type and name
+func (m *MemoryProvider) GetRecord(recordType, name string) (DNSRecord, error) {
+	records, err := m.ListRecords(RecordFilter{RecordType: recordType, Name: name})
+	if err != nil || len(records) == 0 {
+		return DNSRecord{}, err
+	}
+	return records[0], nil
+}
+
+//CreateRecord - Store a new record with a generated ID
+func (m *MemoryProvider) CreateRecord(record DNSRecord) (DNSRecord, error) {
+	if err := m.ManagesName(record.Name); err != nil {
+		return DNSRecord{}, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.nextID++
+	record.ID = strconv.Itoa(m.nextID)
+	m.records[record.ID] = record
+	return record, nil
+}
+
+//UpdateRecord - Replace the record with the same ID
+func (m *MemoryProvider) UpdateRecord(record DNSRecord) (DNSRecord, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.records[record.ID]; !ok {
+		return DNSRecord{}, &PermanentError{Err: &NotFoundError{Err: errors.New("record " + record.ID + " does not exist")}}
+	}
+	m.records[record.ID] = record
+	return record, nil
+}
+
+//DeleteRecord - Remove the record with the same ID
+func (m *MemoryProvider) DeleteRecord(record DNSRecord) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.records[record.ID]; !ok {
+		return &PermanentError{Err: &NotFoundError{Err: errors.New("record " + record.ID + " does not exist")}}
+	}
+	delete(m.records, record.ID)
+	return nil
+}
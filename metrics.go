@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+//Gauge - A value reported by the metrics endpoint
+type Gauge struct {
+	Name  string
+	Help  string
+	Value func() float64
+}
+
+//metricsHandler - Serve the gauges in the Prometheus text format
+func metricsHandler(gauges []Gauge) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, gauge := range gauges {
+			fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", gauge.Name, gauge.Help, gauge.Name, gauge.Name, gauge.Value())
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	handler := metricsHandler([]Gauge{{
+		Name:  "cloudflare_api_rate_limit_tokens",
+		Help:  "Requests that can be made right away.",
+		Value: func() float64 { return 42 },
+	}})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+	want := "# HELP cloudflare_api_rate_limit_tokens Requests that can be made right away.\n" +
+		"# TYPE cloudflare_api_rate_limit_tokens gauge\n" +
+		"cloudflare_api_rate_limit_tokens 42\n"
+	if string(body) != want {
+		t.Errorf("metrics = %q, want %q", body, want)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"k8s.io/klog"
+)
+
+//Plan - The changes that bring the records to the desired state
+type Plan struct {
+	Creates []DNSRecord
+	Updates []DNSRecord
+	Deletes []DNSRecord
+}
+
+//Empty - Check if the plan has no changes
+func (p Plan) Empty() bool {
+	return len(p.Creates) == 0 && len(p.Updates) == 0 && len(p.Deletes) == 0
+}
+
+//Merge - The changes of both plans
+func (p Plan) Merge(other Plan) Plan {
+	return Plan{
+		Creates: append(append([]DNSRecord{}, p.Creates...), other.Creates...),
+		Updates: append(append([]DNSRecord{}, p.Updates...), other.Updates...),
+		Deletes: append(append([]DNSRecord{}, p.Deletes...), other.Deletes...),
+	}
+}
+
+//BatchProvider - A DNSProvider that can apply a whole plan in one call
+type BatchProvider interface {
+	//ApplyBatch returns ErrBatchUnsupported, without applying any change, if batches
+	//can't be used and the changes must be made one at a time, and a *BatchError if it
+	//failed after applying part of the plan
+	ApplyBatch(plan Plan) error
+}
+
+//ErrBatchUnsupported - Returned by ApplyBatch when the provider can't apply batches
+var ErrBatchUnsupported = errors.New("batch changes are not supported")
+
+//BatchError - Returned by ApplyBatch when a batch failed after part of the plan was applied,
+//e.g. the batch of one zone was applied and the batch of the next zone was rejected
+type BatchError struct {
+	//Applied are the changes that were made, Remaining are the changes that weren't
+	Applied   Plan
+	Remaining Plan
+	Err       error
+}
+
+func (e *BatchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+//applyPlan - Apply the plan as a batch if the provider supports it, otherwise one record at
+//a time. The changes of a batch the provider rejects are also applied one record at a time,
+//so a single bad record doesn't hold back the rest of the zone, while the changes of batches
+//that were applied aren't made again. Records are grouped by the hostname returned
+//by hostname. TXT registry records are created before the A and AAAA records they own and
+//deleted after them, and the records of a hostname are skipped once one of its changes
+//failed, so records are never left without an owner. Returns the changes that were applied
+//and the first error, preferring errors that will be retried.
+func applyPlan(provider DNSProvider, plan Plan, hostname func(DNSRecord) string) (Plan, error) {
+	if plan.Empty() {
+		return plan, nil
+	}
+	applied := Plan{}
+	if batch, ok := provider.(BatchProvider); ok {
+		err := batch.ApplyBatch(plan)
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			applied, plan = batchErr.Applied, batchErr.Remaining
+		}
+		switch {
+		case err == nil:
+			return plan, nil
+		case err == ErrBatchUnsupported:
+			klog.V(2).Info("Batch changes are not supported, applying the plan one record at a time")
+		case isPermanent(err):
+			klog.Warningf("Batch was rejected, applying the rest of the plan one record at a time: %v", err)
+		default:
+			return applied, err
+		}
+	}
+
+	creates := append([]DNSRecord{}, plan.Creates...)
+	sort.SliceStable(creates, func(i, j int) bool {
+		return creates[i].RecordType == "TXT" && creates[j].RecordType != "TXT"
+	})
+	deletes := append([]DNSRecord{}, plan.Deletes...)
+	sort.SliceStable(deletes, func(i, j int) bool {
+		return deletes[i].RecordType != "TXT" && deletes[j].RecordType == "TXT"
+	})
+
+	failed := map[string]bool{}
+	var firstErr error
+	fail := func(record DNSRecord, err error) {
+		klog.Errorf("Failed to apply %v record %v: %v", record.RecordType, record.Name, err)
+		failed[hostname(record)] = true
+		if firstErr == nil || (isPermanent(firstErr) && !isPermanent(err)) {
+			firstErr = err
+		}
+	}
+	for _, record := range creates {
+		if record.RecordType != "TXT" && failed[hostname(record)] {
+			continue
+		}
+		if _, err := provider.CreateRecord(record); err != nil {
+			fail(record, err)
+			continue
+		}
+		applied.Creates = append(applied.Creates, record)
+	}
+	for _, record := range plan.Updates {
+		if _, err := provider.UpdateRecord(record); err != nil {
+			fail(record, err)
+			continue
+		}
+		applied.Updates = append(applied.Updates, record)
+	}
+	for _, record := range deletes {
+		if record.RecordType == "TXT" && failed[hostname(record)] {
+			continue
+		}
+		if err := provider.DeleteRecord(record); err != nil {
+			fail(record, err)
+			continue
+		}
+		applied.Deletes = append(applied.Deletes, record)
+	}
+	return applied, firstErr
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Sync policies, also the values of the policy annotation
+const (
+	//PolicySync - Create, update and delete records
+	PolicySync = "sync"
+	//PolicyUpsertOnly - Create and update records but never delete them
+	PolicyUpsertOnly = "upsert-only"
+	//PolicyCreateOnly - Create missing records but never change or delete existing ones
+	PolicyCreateOnly = "create-only"
+)
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case PolicySync, PolicyUpsertOnly, PolicyCreateOnly:
+		return nil
+	}
+	return fmt.Errorf("sync policy must be %v, %v or %v, not %q", PolicySync, PolicyUpsertOnly, PolicyCreateOnly, policy)
+}
+
+//annotatedPolicy - The value of the policy annotation, empty if the object doesn't have one
+func annotatedPolicy(annotations map[string]string) (string, error) {
+	value, ok := annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/policy"]
+	if !ok {
+		return "", nil
+	}
+	policy := strings.ToLower(value)
+	return policy, validatePolicy(policy)
+}
+
+//policyAllowsUpdate - Check if existing records may be changed
+func policyAllowsUpdate(policy string) bool {
+	return policy == PolicySync || policy == PolicyUpsertOnly
+}
+
+//policyAllowsDelete - Check if records may be deleted
+func policyAllowsDelete(policy string) bool {
+	return policy == PolicySync
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+)
+
+func TestCloudflareSyncPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		global     string
+		annotation string
+		//The records after the IP changed and the Service lost web.example.com, and after it was deleted
+		wantChanged []string
+		wantDeleted []string
+	}{
+		{
+			name:   "sync",
+			global: PolicySync,
+			wantChanged: []string{
+				"A api.example.com 5.6.7.8",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+			},
+			wantDeleted: []string{},
+		},
+		{
+			name:       "upsert-only annotation",
+			global:     PolicySync,
+			annotation: PolicyUpsertOnly,
+			wantChanged: []string{
+				"A api.example.com 5.6.7.8",
+				"A web.example.com 1.2.3.4",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=upsert-only",
+				"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=upsert-only",
+			},
+			wantDeleted: []string{
+				"A api.example.com 5.6.7.8",
+				"A web.example.com 1.2.3.4",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=upsert-only",
+				"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=upsert-only",
+			},
+		},
+		{
+			name:       "create-only annotation",
+			global:     PolicySync,
+			annotation: PolicyCreateOnly,
+			wantChanged: []string{
+				"A api.example.com 1.2.3.4",
+				"A web.example.com 1.2.3.4",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only",
+				"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only",
+			},
+			wantDeleted: []string{
+				"A api.example.com 1.2.3.4",
+				"A web.example.com 1.2.3.4",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only",
+				"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only",
+			},
+		},
+		{
+			name:   "upsert-only global",
+			global: PolicyUpsertOnly,
+			wantChanged: []string{
+				"A api.example.com 5.6.7.8",
+				"A web.example.com 1.2.3.4",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+				"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+			},
+			wantDeleted: []string{
+				"A api.example.com 5.6.7.8",
+				"A web.example.com 1.2.3.4",
+				"TXT api.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+				"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, server := newTestCloudflare(t)
+			defer server.Close()
+			controller, _ := newTestController(cf, "1.2.3.4")
+			controller.config.Policy = tt.global
+			annotations := map[string]string{"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com,api.example.com"}
+			if tt.annotation != "" {
+				annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/policy"] = tt.annotation
+			}
+			service := newTestService("web", annotations)
+			controller.serviceIndexer.Add(service)
+			if err := controller.cloudflareSync("service/default/web"); err != nil {
+				t.Fatalf("cloudflareSync() error = %v", err)
+			}
+
+			controller.currentIP.Set("5.6.7.8")
+			annotations["cloudflare-dynamic-dns.alpha.kubernetes.io/hostname"] = "api.example.com"
+			if err := controller.cloudflareSync("service/default/web"); err != nil {
+				t.Fatalf("cloudflareSync() error = %v", err)
+			}
+			if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, tt.wantChanged) {
+				t.Errorf("records after changes = %v, want %v", got, tt.wantChanged)
+			}
+
+			//The policy of the deleted object is read from its TXT records
+			controller.serviceIndexer.Delete(service)
+			if err := controller.cloudflareSync("service/default/web"); err != nil {
+				t.Fatalf("cloudflareSync() error = %v", err)
+			}
+			if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, tt.wantDeleted) {
+				t.Errorf("records after delete = %v, want %v", got, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestReconcilePolicies(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "old.example.com", Content: "9.9.9.9"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "old.example.com", Content: "heritage=cf-ddns,owner=default,resource=service/default/old"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "web.example.com", Content: "9.9.9.9"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "web.example.com", Content: "heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "kept.example.com", Content: "9.9.9.9"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "kept.example.com", Content: "heritage=cf-ddns,owner=default,resource=service/default/kept,policy=upsert-only"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "synced.example.com", Content: "9.9.9.9"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "synced.example.com", Content: "heritage=cf-ddns,owner=default,resource=service/default/synced,policy=sync"})
+	controller, _ := newTestController(cf, "1.2.3.4")
+	controller.config.Policy = PolicyUpsertOnly
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com,new.example.com",
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/policy":   PolicyCreateOnly,
+	}))
+	controller.serviceIndexer.Add(newTestService("kept", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/policy": PolicyUpsertOnly,
+	}))
+
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+
+	//The orphan of a deleted object without a policy is kept by the global policy, and the one of
+	//the object that no longer wants records by its annotation. The deleted object that had the
+	//sync policy has its records deleted, and web.example.com is kept by the annotation.
+	want := []string{
+		"A kept.example.com 9.9.9.9",
+		"A new.example.com 1.2.3.4",
+		"A old.example.com 9.9.9.9",
+		"A web.example.com 9.9.9.9",
+		"TXT kept.example.com heritage=cf-ddns,owner=default,resource=service/default/kept,policy=upsert-only",
+		"TXT new.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only",
+		"TXT old.example.com heritage=cf-ddns,owner=default,resource=service/default/old",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web,policy=create-only",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reconcile = %v, want %v", got, want)
+	}
+}
+
+func TestCollectGarbagePolicies(t *testing.T) {
+	controller, _ := newTestController(NewMemoryProvider(nil), "1.2.3.4")
+	for _, record := range []DNSRecord{
+		{RecordType: "A", Name: "sync.example.com", Content: "1.2.3.4"},
+		{RecordType: "TXT", Name: "sync.example.com", Content: registryContent(DefaultOwnerID, "service/default/sync", "", "")},
+		{RecordType: "A", Name: "deleted.example.com", Content: "1.2.3.4"},
+		{RecordType: "TXT", Name: "deleted.example.com", Content: registryContent(DefaultOwnerID, "service/default/deleted", "", PolicyUpsertOnly)},
+		{RecordType: "A", Name: "unwanted.example.com", Content: "1.2.3.4"},
+		{RecordType: "TXT", Name: "unwanted.example.com", Content: registryContent(DefaultOwnerID, "service/default/unwanted", "", "")},
+	} {
+		controller.provider.CreateRecord(record)
+	}
+	controller.serviceIndexer.Add(newTestService("unwanted", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/policy": PolicyCreateOnly,
+	}))
+
+	//Only the records of the deleted object without a policy are deleted
+	if got := controller.collectGarbage(); got != 3 {
+		t.Errorf("collectGarbage() = %d, want 3", got)
+	}
+	records, _ := controller.provider.ListRecords(RecordFilter{})
+	want := []string{"deleted.example.com", "deleted.example.com", "unwanted.example.com", "unwanted.example.com"}
+	got := []string{}
+	for _, record := range records {
+		got = append(got, record.Name)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records after garbage collection = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+//DNSRecord - A provider neutral DNS record
+type DNSRecord struct {
+	ID         string
+	RecordType string
+	Name       string
+	Content    string
+	TTL        int
+	Proxied    bool
+}
+
+//ProviderCapabilities - Optional features a DNSProvider supports
+type ProviderCapabilities struct {
+	SupportsProxying bool
+}
+
+//DNSProvider - Manages the DNS records the controller publishes
+type DNSProvider interface {
+	//ManagesName returns a *ZoneNotManagedError if the name is outside every managed zone
+	ManagesName(name string) error
+	ListRecords(filter RecordFilter) ([]DNSRecord, error)
+	//GetRecord returns an empty record if there is no record with the type and name
+	GetRecord(recordType, name string) (DNSRecord, error)
+	CreateRecord(record DNSRecord) (DNSRecord, error)
+	UpdateRecord(record DNSRecord) (DNSRecord, error)
+	DeleteRecord(record DNSRecord) error
+	Capabilities() ProviderCapabilities
+}
+
+//RecordFilter - Filters used when listing records, empty fields are not filtered on
+type RecordFilter struct {
+	RecordType string
+	Name       string
+	Content    string
+}
+
+//Matches - Check if a record matches the filter, names are compared ignoring case
+func (f RecordFilter) Matches(record DNSRecord) bool {
+	if f.RecordType != "" && f.RecordType != record.RecordType {
+		return false
+	}
+	if f.Name != "" && !strings.EqualFold(f.Name, record.Name) {
+		return false
+	}
+	if f.Content != "" && f.Content != record.Content {
+		return false
+	}
+	return true
+}
+
+//RetryableError - A temporary failure, such as a rate limit or a server error. The sync is
+//retried with backoff.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+//PermanentError - A failure retrying won't fix, such as a record the provider rejects
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+//NotFoundError - The record to update or delete doesn't exist. The provider returns it wrapped
+//in a *PermanentError, since repeating the request won't help.
+type NotFoundError struct {
+	Err error
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+//isPermanent - Check if retrying won't help. Errors that aren't known to be permanent are retried.
+func isPermanent(err error) bool {
+	var permanent *PermanentError
+	var zoneNotManaged *ZoneNotManagedError
+	var conflict *OwnershipConflictError
+	return errors.As(err, &permanent) || errors.As(err, &zoneNotManaged) || errors.As(err, &conflict)
+}
+
+//SyncResult - What syncRecord changed
+type SyncResult int
+
+const (
+	RecordUnchanged SyncResult = iota
+	RecordCreated
+	RecordUpdated
+)
+
+//syncRecord - Create the record if it doesn't exist, otherwise update it if it changed
+func syncRecord(provider DNSProvider, newRecord DNSRecord) (SyncResult, error) {
+	if !provider.Capabilities().SupportsProxying {
+		newRecord.Proxied = false
+	}
+
+	record, err := provider.GetRecord(newRecord.RecordType, newRecord.Name)
+	if err != nil {
+		return RecordUnchanged, err
+	}
+	if record.ID == "" {
+		_, err = provider.CreateRecord(newRecord)
+		return RecordCreated, err
+	}
+
+	//Copy the ID since we don't care about comparing it
+	newRecord.ID = record.ID
+	if record != newRecord {
+		_, err = provider.UpdateRecord(newRecord)
+		return RecordUpdated, err
+	}
+
+	return RecordUnchanged, nil
+}
+
+//createMissingRecord - Create the record if there is none with its type and name, an existing
+//record is left as it is
+func createMissingRecord(provider DNSProvider, newRecord DNSRecord) (SyncResult, error) {
+	if !provider.Capabilities().SupportsProxying {
+		newRecord.Proxied = false
+	}
+
+	record, err := provider.GetRecord(newRecord.RecordType, newRecord.Name)
+	if err != nil || record.ID != "" {
+		return RecordUnchanged, err
+	}
+	_, err = provider.CreateRecord(newRecord)
+	return RecordCreated, err
+}
+
+//deleteRecordByName - Delete the record with the type and name if it exists, reporting if it did
+func deleteRecordByName(provider DNSProvider, recordType, name string) (bool, error) {
+	record, err := provider.GetRecord(recordType, name)
+	if err != nil {
+		return false, err
+	}
+	if record.ID == "" {
+		return false, nil
+	}
+
+	return true, provider.DeleteRecord(record)
+}
@@ -2,54 +2,229 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"net"
 	"sync"
 	"time"
+
+	"k8s.io/klog"
 )
 
+//CurrentIP - The last known good public IPv4 and IPv6 addresses. Set rejects anything that
+//isn't a public address unless AllowPrivate is set, e.g. for clusters behind carrier-grade NAT.
 type CurrentIP struct {
-	ip  string
-	mux sync.Mutex
+	AllowPrivate bool
+	ip           string
+	ip6          string
+	staleSince   time.Time
+	subscribers  []chan IPChange
+	mux          sync.Mutex
+}
+
+//Address families, also the values of the ip-family annotation
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyDual = "dual"
+)
+
+//nonPublicIPNets - Ranges that can never be reached from the internet
+var nonPublicIPNets = parseCIDRs(
+	"0.0.0.0/8",      //"This" network
+	"10.0.0.0/8",     //Private
+	"100.64.0.0/10",  //Carrier-grade NAT
+	"127.0.0.0/8",    //Loopback
+	"169.254.0.0/16", //Link local
+	"172.16.0.0/12",  //Private
+	"192.168.0.0/16", //Private
+	"::1/128",        //Loopback
+	"fc00::/7",       //Unique local
+	"fe80::/10",      //Link local
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
 }
 
+//validateIP - Check the IP can be published as an A record
+func validateIP(ip string, allowPrivate bool) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("%.40q is not an IP address", ip)
+	}
+	if parsed.IsUnspecified() || parsed.IsMulticast() {
+		return fmt.Errorf("%v is not a unicast address", ip)
+	}
+	if allowPrivate {
+		return nil
+	}
+	for _, ipNet := range nonPublicIPNets {
+		if ipNet.Contains(parsed) {
+			return fmt.Errorf("%v is not a public address (%v)", ip, ipNet)
+		}
+	}
+	return nil
+}
+
+//IPChange - Published to subscribers when the public IP of a family changes
+type IPChange struct {
+	Family string
+	Old    string
+	New    string
+}
+
+//Get - The public IPv4 address
 func (c *CurrentIP) Get() string {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 	return c.ip
 }
 
-func (c *CurrentIP) Set(ip string) {
+//GetV6 - The public IPv6 address, empty if there is none
+func (c *CurrentIP) GetV6() string {
 	c.mux.Lock()
-	c.ip = ip
-	c.mux.Unlock()
+	defer c.mux.Unlock()
+	return c.ip6
 }
 
-func getPublicIP() (ip string, err error) {
-	resp, err := http.Get("http://api.ipify.org")
-	if err != nil {
-		return "", err
+//ipFamily - The family of a valid IP address
+func ipFamily(ip string) string {
+	if net.ParseIP(ip).To4() != nil {
+		return FamilyIPv4
 	}
-	publicIPRaw, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return "", err
+	return FamilyIPv6
+}
+
+//Set - Store the IP as the address of its family if it is valid, otherwise the last
+//known good IP is kept
+func (c *CurrentIP) Set(ip string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err := validateIP(ip, c.AllowPrivate); err != nil {
+		return err
 	}
 
-	return string(publicIPRaw), nil
+	if ipFamily(ip) == FamilyIPv6 {
+		c.setLocked(FamilyIPv6, &c.ip6, ip)
+		return nil
+	}
+	c.staleSince = time.Time{}
+	c.setLocked(FamilyIPv4, &c.ip, ip)
+	return nil
 }
 
-func watchPublicIP(currentIP *CurrentIP) {
+//ClearV6 - Forget the IPv6 address once the network no longer has one
+func (c *CurrentIP) ClearV6() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.setLocked(FamilyIPv6, &c.ip6, "")
+}
+
+//setLocked - Update the address and notify subscribers if it changed
+func (c *CurrentIP) setLocked(family string, current *string, ip string) {
+	if *current == ip {
+		return
+	}
+	change := IPChange{Family: family, Old: *current, New: ip}
+	*current = ip
+
+	//Never block the watcher on a slow subscriber. The channel has room for a change
+	//of each family, and a pending change of the same family is merged with the new
+	//one so the subscriber still sees the original old IP.
+	for _, ch := range c.subscribers {
+		pending := []IPChange{}
+	drain:
+		for {
+			select {
+			case p := <-ch:
+				pending = append(pending, p)
+			default:
+				break drain
+			}
+		}
+		merged := change
+		for _, p := range pending {
+			if p.Family == family {
+				merged.Old = p.Old
+			} else {
+				ch <- p
+			}
+		}
+		ch <- merged
+	}
+}
+
+//MarkStale - Record that the IPv4 address could not be refreshed, keeping the first failure time
+func (c *CurrentIP) MarkStale() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.staleSince.IsZero() {
+		c.staleSince = time.Now()
+	}
+}
+
+//StaleSince - When refreshing the IP started failing, zero if the last refresh succeeded
+func (c *CurrentIP) StaleSince() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.staleSince
+}
+
+//Subscribe - Get a channel that receives every change of the public IP
+func (c *CurrentIP) Subscribe() <-chan IPChange {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ch := make(chan IPChange, 2)
+	c.subscribers = append(c.subscribers, ch)
+	return ch
+}
+
+//ipv6MissingChecks - Failed IPv6 checks in a row before the address is considered gone
+const ipv6MissingChecks = 3
+
+//watchPublicIP - Refresh the public IPs every 30 seconds. detector6 is nil when IPv6 is disabled.
+func watchPublicIP(currentIP *CurrentIP, detector *PublicIPDetector, detector6 *PublicIPDetector) {
 	ticker := time.NewTicker(30 * time.Second)
+	failures6 := 0
 	for {
-		publicIP, err := getPublicIP()
+		publicIP, err := detector.Detect()
+		if err == nil {
+			err = currentIP.Set(publicIP)
+		}
 		if err != nil {
-			println("Could not retrieve IP. Retry on next check...")
+			currentIP.MarkStale()
+			klog.Warningf("Could not retrieve IP, keeping %q (stale since %v). Retry on next check: %v",
+				currentIP.Get(), currentIP.StaleSince().Format(time.RFC3339), err)
+		} else {
+			println(currentIP.Get())
 		}
-		if currentIP.Get() != publicIP {
-			currentIP.Set(publicIP)
+
+		//A network without IPv6 looks the same as a failed check, so the address is
+		//only dropped after several failures to avoid deleting AAAA records on a blip.
+		if detector6 != nil {
+			publicIP6, err := detector6.Detect()
+			if err == nil {
+				err = currentIP.Set(publicIP6)
+			}
+			if err == nil {
+				failures6 = 0
+				klog.V(2).Infof("Public IPv6 address is %v", currentIP.GetV6())
+			} else {
+				failures6++
+				klog.Warningf("Could not retrieve IPv6 address (%d/%d): %v", failures6, ipv6MissingChecks, err)
+				if failures6 >= ipv6MissingChecks && currentIP.GetV6() != "" {
+					klog.Warningf("IPv6 address %v is no longer available", currentIP.GetV6())
+					currentIP.ClearV6()
+				}
+			}
 		}
-		println(currentIP.Get())
 		<-ticker.C
 	}
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//PublicIPSource - A service that reports the public IP requests are made from
+type PublicIPSource interface {
+	Name() string
+	Fetch(client *http.Client) (net.IP, error)
+}
+
+//textIPSource - Source that responds with the IP as the whole plain text body
+type textIPSource struct {
+	name string
+	url  string
+}
+
+func (s textIPSource) Name() string {
+	return s.name
+}
+
+func (s textIPSource) Fetch(client *http.Client) (net.IP, error) {
+	body, err := fetchBody(client, s.url)
+	if err != nil {
+		return nil, err
+	}
+	return parseIP(body)
+}
+
+//cloudflareTraceSource - Cloudflare's cdn-cgi/trace, which responds with key=value lines
+type cloudflareTraceSource struct {
+	url string
+}
+
+func (s cloudflareTraceSource) Name() string {
+	return "cloudflare"
+}
+
+func (s cloudflareTraceSource) Fetch(client *http.Client) (net.IP, error) {
+	body, err := fetchBody(client, s.url)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "ip=") {
+			return parseIP(strings.TrimPrefix(line, "ip="))
+		}
+	}
+	return nil, errors.New("no ip in trace response")
+}
+
+//fetchBody - GET the URL and return the body, which is expected to be small
+func fetchBody(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+//parseIP - Parse a response body, rejecting anything that isn't a bare IP address
+func parseIP(body string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(body))
+	if ip == nil {
+		return nil, fmt.Errorf("response is not an IP address: %.40q", body)
+	}
+	return ip, nil
+}
+
+//NewPublicIPSource - Get a built in source by name, or a custom source for a URL
+//that responds with the IP as plain text. Built in sources other than aws answer
+//over both IPv4 and IPv6.
+func NewPublicIPSource(spec string) (PublicIPSource, error) {
+	switch spec {
+	case "ipify":
+		return textIPSource{name: "ipify", url: "https://api64.ipify.org"}, nil
+	case "icanhazip":
+		return textIPSource{name: "icanhazip", url: "https://icanhazip.com"}, nil
+	case "cloudflare":
+		return cloudflareTraceSource{url: "https://www.cloudflare.com/cdn-cgi/trace"}, nil
+	case "aws":
+		return textIPSource{name: "aws", url: "https://checkip.amazonaws.com"}, nil
+	}
+	if strings.HasPrefix(spec, "https://") || strings.HasPrefix(spec, "http://") {
+		return textIPSource{name: spec, url: spec}, nil
+	}
+	return nil, fmt.Errorf("unknown public IP source %v", spec)
+}
+
+//Strategies for combining the results of several sources
+const (
+	//StrategyFirst - Use the first source that responds with an IP
+	StrategyFirst = "first"
+	//StrategyMajority - Use the IP reported by more than half of the sources
+	StrategyMajority = "majority"
+	//StrategyAll - Every source must respond with the same IP
+	StrategyAll = "all"
+)
+
+//PublicIPDetector - Finds the public IP of one address family by asking several sources
+type PublicIPDetector struct {
+	Sources  []PublicIPSource
+	Strategy string
+	Family   string
+	Client   *http.Client
+}
+
+func NewPublicIPDetector(sources []PublicIPSource, strategy, family string) (*PublicIPDetector, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no public IP sources configured")
+	}
+	switch strategy {
+	case StrategyFirst, StrategyMajority, StrategyAll:
+	default:
+		return nil, fmt.Errorf("unknown public IP strategy %v", strategy)
+	}
+
+	//Force the family of the connection so sources report the address of that family
+	var network string
+	switch family {
+	case FamilyIPv4:
+		network = "tcp4"
+	case FamilyIPv6:
+		network = "tcp6"
+	default:
+		return nil, fmt.Errorf("unknown address family %v", family)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return &PublicIPDetector{
+		Sources:  sources,
+		Strategy: strategy,
+		Family:   family,
+		Client:   &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}, nil
+}
+
+//Detect - Ask the sources for the public IP and combine the answers using the strategy
+func (d *PublicIPDetector) Detect() (string, error) {
+	votes := map[string]int{}
+	var errs []string
+	for _, source := range d.Sources {
+		ip, err := source.Fetch(d.Client)
+		if err == nil && ipFamily(ip.String()) != d.Family {
+			err = fmt.Errorf("%v is not an %v address", ip, d.Family)
+		}
+		if err != nil {
+			errs = append(errs, source.Name()+": "+err.Error())
+			if d.Strategy == StrategyAll {
+				break
+			}
+			continue
+		}
+		if d.Strategy == StrategyFirst {
+			return ip.String(), nil
+		}
+		votes[ip.String()]++
+	}
+
+	for ip, count := range votes {
+		switch d.Strategy {
+		case StrategyMajority:
+			if count > len(d.Sources)/2 {
+				return ip, nil
+			}
+		case StrategyAll:
+			if count == len(d.Sources) {
+				return ip, nil
+			}
+		}
+	}
+
+	if len(votes) > 1 {
+		errs = append(errs, fmt.Sprintf("sources disagree: %v", votes))
+	}
+	return "", fmt.Errorf("could not detect public IP with the %v strategy: %v", d.Strategy, strings.Join(errs, "; "))
+}
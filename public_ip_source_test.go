@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//newTestIPSource - Source backed by a server that always responds with the body
+func newTestIPSource(t *testing.T, body string) (PublicIPSource, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	source, err := NewPublicIPSource(server.URL)
+	if err != nil {
+		t.Fatalf("NewPublicIPSource() error = %v", err)
+	}
+	return source, server
+}
+
+func TestPublicIPDetectorStrategies(t *testing.T) {
+	good, goodServer := newTestIPSource(t, "1.2.3.4\n")
+	defer goodServer.Close()
+	other, otherServer := newTestIPSource(t, "5.6.7.8")
+	defer otherServer.Close()
+	html, htmlServer := newTestIPSource(t, "<html>Service Unavailable</html>")
+	defer htmlServer.Close()
+	v6, v6Server := newTestIPSource(t, "2001:db8::1")
+	defer v6Server.Close()
+
+	tests := []struct {
+		name     string
+		sources  []PublicIPSource
+		strategy string
+		want     string
+	}{
+		{name: "first skips invalid", sources: []PublicIPSource{html, good}, strategy: StrategyFirst, want: "1.2.3.4"},
+		{name: "first all invalid", sources: []PublicIPSource{html}, strategy: StrategyFirst, want: ""},
+		{name: "first skips other family", sources: []PublicIPSource{v6, good}, strategy: StrategyFirst, want: "1.2.3.4"},
+		{name: "majority", sources: []PublicIPSource{good, other, good}, strategy: StrategyMajority, want: "1.2.3.4"},
+		{name: "majority counts failures", sources: []PublicIPSource{good, html, other}, strategy: StrategyMajority, want: ""},
+		{name: "all agree", sources: []PublicIPSource{good, good}, strategy: StrategyAll, want: "1.2.3.4"},
+		{name: "all disagree", sources: []PublicIPSource{good, other}, strategy: StrategyAll, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, err := NewPublicIPDetector(tt.sources, tt.strategy, FamilyIPv4)
+			if err != nil {
+				t.Fatalf("NewPublicIPDetector() error = %v", err)
+			}
+			got, err := detector.Detect()
+			if got != tt.want || (err != nil) != (tt.want == "") {
+				t.Errorf("Detect() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudflareTraceSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fl=123\nh=www.cloudflare.com\nip=2001:db8::1\nts=1\n"))
+	}))
+	defer server.Close()
+
+	ip, err := cloudflareTraceSource{url: server.URL}.Fetch(server.Client())
+	if err != nil || ip.String() != "2001:db8::1" {
+		t.Errorf("Fetch() = %v, %v", ip, err)
+	}
+}
+
+func TestNewPublicIPSource(t *testing.T) {
+	for _, spec := range []string{"ipify", "icanhazip", "cloudflare", "aws", "https://ip.example.com"} {
+		if _, err := NewPublicIPSource(spec); err != nil {
+			t.Errorf("NewPublicIPSource(%q) error = %v", spec, err)
+		}
+	}
+	if _, err := NewPublicIPSource("example"); err == nil {
+		t.Error("NewPublicIPSource() of an unknown source succeeded")
+	}
+	if _, err := NewPublicIPDetector([]PublicIPSource{textIPSource{}}, "best", FamilyIPv4); err == nil {
+		t.Error("NewPublicIPDetector() with an unknown strategy succeeded")
+	}
+	if _, err := NewPublicIPDetector([]PublicIPSource{textIPSource{}}, StrategyFirst, FamilyDual); err == nil {
+		t.Error("NewPublicIPDetector() with the dual family succeeded")
+	}
+}
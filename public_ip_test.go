@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrentIPSubscribe(t *testing.T) {
+	currentIP := &CurrentIP{}
+	changes := currentIP.Subscribe()
+
+	currentIP.Set("1.2.3.4")
+	if change := <-changes; change != (IPChange{Family: FamilyIPv4, Old: "", New: "1.2.3.4"}) {
+		t.Errorf("change = %+v", change)
+	}
+
+	//Setting the same IP is not a change
+	currentIP.Set("1.2.3.4")
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected change %+v", change)
+	default:
+	}
+
+	//Changes the subscriber hasn't read yet are merged per family
+	currentIP.Set("5.6.7.8")
+	currentIP.Set("2001:db8::1")
+	currentIP.Set("9.9.9.9")
+	currentIP.ClearV6()
+	want := []IPChange{
+		{Family: FamilyIPv4, Old: "1.2.3.4", New: "9.9.9.9"},
+		{Family: FamilyIPv6, Old: "", New: ""},
+	}
+	for _, w := range want {
+		if change := <-changes; change != w {
+			t.Errorf("merged change = %+v, want %+v", change, w)
+		}
+	}
+	if currentIP.Get() != "9.9.9.9" || currentIP.GetV6() != "" {
+		t.Errorf("Get() = %q, GetV6() = %q", currentIP.Get(), currentIP.GetV6())
+	}
+}
+
+func TestCurrentIPRejectsInvalid(t *testing.T) {
+	currentIP := &CurrentIP{}
+	if err := currentIP.Set("1.2.3.4"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	for _, ip := range []string{"", "<html>", "10.1.2.3", "100.64.0.1", "127.0.0.1", "192.168.1.1", "fd00::1", "::1", "0.0.0.0"} {
+		if err := currentIP.Set(ip); err == nil {
+			t.Errorf("Set(%q) succeeded", ip)
+		}
+	}
+	if got := currentIP.Get(); got != "1.2.3.4" {
+		t.Errorf("Get() = %q, want the last known good IP", got)
+	}
+
+	currentIP.AllowPrivate = true
+	if err := currentIP.Set("100.64.0.1"); err != nil {
+		t.Errorf("Set() of a private IP with AllowPrivate error = %v", err)
+	}
+	if err := currentIP.Set("not an ip"); err == nil {
+		t.Error("Set() of garbage with AllowPrivate succeeded")
+	}
+}
+
+func TestCurrentIPStaleSince(t *testing.T) {
+	currentIP := &CurrentIP{}
+	if !currentIP.StaleSince().IsZero() {
+		t.Fatal("new CurrentIP is stale")
+	}
+
+	currentIP.MarkStale()
+	first := currentIP.StaleSince()
+	time.Sleep(time.Millisecond)
+	currentIP.MarkStale()
+	if first.IsZero() || !currentIP.StaleSince().Equal(first) {
+		t.Errorf("StaleSince() = %v, want the first failure %v", currentIP.StaleSince(), first)
+	}
+
+	currentIP.Set("1.2.3.4")
+	if !currentIP.StaleSince().IsZero() {
+		t.Error("StaleSince() is set after a successful refresh")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//RateLimiter - Token bucket that allows Limit requests per Period on average. The bucket holds a
+//tenth of the limit, so a burst followed by the steady rate stays close to the limit in any period.
+type RateLimiter struct {
+	Limit       int
+	Period      time.Duration
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	mux         sync.Mutex
+}
+
+func NewRateLimiter(limit int, period time.Duration) *RateLimiter {
+	r := &RateLimiter{Limit: limit, Period: period, last: time.Now()}
+	r.tokens = r.burst()
+	return r
+}
+
+func (r *RateLimiter) burst() float64 {
+	return math.Max(1, float64(r.Limit)/10)
+}
+
+//refillLocked - Add the tokens earned since the last refill
+func (r *RateLimiter) refillLocked(now time.Time) {
+	rate := float64(r.Limit) / r.Period.Seconds()
+	r.tokens = math.Min(r.burst(), r.tokens+now.Sub(r.last).Seconds()*rate)
+	r.last = now
+}
+
+//Wait - Block until a request is allowed
+func (r *RateLimiter) Wait() {
+	for {
+		r.mux.Lock()
+		now := time.Now()
+		r.refillLocked(now)
+		var wait time.Duration
+		if now.Before(r.pausedUntil) {
+			wait = r.pausedUntil.Sub(now)
+		} else if r.tokens >= 1 {
+			r.tokens--
+			r.mux.Unlock()
+			return
+		} else {
+			wait = time.Duration((1 - r.tokens) / float64(r.Limit) * float64(r.Period))
+		}
+		r.mux.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+//Pause - Hold every request for the duration and empty the bucket, e.g. after the API rate limited us
+func (r *RateLimiter) Pause(d time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if until := time.Now().Add(d); until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+	r.tokens = 0
+}
+
+//Tokens - The number of requests that can be made right away
+func (r *RateLimiter) Tokens() float64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := time.Now()
+	r.refillLocked(now)
+	if now.Before(r.pausedUntil) {
+		return 0
+	}
+	return math.Floor(r.tokens)
+}
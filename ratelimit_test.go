@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(600, time.Minute)
+	if tokens := limiter.Tokens(); tokens != 60 {
+		t.Fatalf("Tokens() = %v, want a burst of 60", tokens)
+	}
+	for i := 0; i < 60; i++ {
+		limiter.Wait()
+	}
+	if tokens := limiter.Tokens(); tokens != 0 {
+		t.Errorf("Tokens() after the burst = %v, want 0", tokens)
+	}
+
+	//The bucket refills at 10 requests per second
+	start := time.Now()
+	limiter.Wait()
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > time.Second {
+		t.Errorf("Wait() on an empty bucket took %v, want about 100ms", waited)
+	}
+
+	limiter.Pause(200 * time.Millisecond)
+	start = time.Now()
+	limiter.Wait()
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("Wait() while paused took %v, want at least 200ms", waited)
+	}
+}
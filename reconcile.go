@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+//Reconcile modes
+const (
+	//ReconcileRecord - Sync the records of each object as it comes off the queue
+	ReconcileRecord = "record"
+	//ReconcilePlan - Compute the changes for every object from one listing of the records and
+	//apply them together, as a batch where the provider supports it
+	ReconcilePlan = "plan"
+)
+
+//reconcileKey - The only key of the queue in plan mode
+const reconcileKey = "reconcile"
+
+//planQueue - Work queue that replaces every key with reconcileKey, so the queue dedups the
+//changes of many objects into one reconcile
+type planQueue struct {
+	workqueue.RateLimitingInterface
+}
+
+func (q planQueue) Add(item interface{}) {
+	q.RateLimitingInterface.Add(reconcileKey)
+}
+
+func (q planQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.RateLimitingInterface.AddAfter(reconcileKey, duration)
+}
+
+func (q planQueue) AddRateLimited(item interface{}) {
+	q.RateLimitingInterface.AddRateLimited(reconcileKey)
+}
+
+//registryRef - A TXT registry record and its parsed content
+type registryRef struct {
+	Record DNSRecord
+	Entry  registryEntry
+}
+
+//reconcile - Bring every record to the state wanted by the Services and Ingresses
+func (c *Controller) reconcile() error {
+	//Plans computed at the same time would both create the missing records
+	c.reconcileMux.Lock()
+	defer c.reconcileMux.Unlock()
+
+	records, err := c.provider.ListRecords(RecordFilter{})
+	if err != nil {
+		return fmt.Errorf("Failed to list records: %w", err)
+	}
+	plan, owners := c.plan(records)
+	if plan.Empty() {
+		return nil
+	}
+
+	fmt.Printf("Applying plan with %d creates, %d updates and %d deletes\n", len(plan.Creates), len(plan.Updates), len(plan.Deletes))
+	applied, err := applyPlan(c.provider, plan, c.recordHostname)
+	for _, record := range applied.Creates {
+		c.recordSynced(owners[record], RecordCreated, record.RecordType, record.Name, record.Content)
+	}
+	for _, record := range applied.Updates {
+		c.recordSynced(owners[record], RecordUpdated, record.RecordType, record.Name, record.Content)
+	}
+	for _, record := range applied.Deletes {
+		c.recordDeleted(owners[record], record.RecordType, record.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to apply plan: %w", err)
+	}
+	return nil
+}
+
+//recordHostname - The hostname a record belongs to, for TXT registry records the hostname they own
+func (c *Controller) recordHostname(record DNSRecord) string {
+	if record.RecordType == "TXT" {
+		return strings.ToLower(c.hostnameFromRegistry(record.Name))
+	}
+	return strings.ToLower(record.Name)
+}
+
+//desiredSpecs - The specs of every Service and Ingress that wants records, and the keys of the
+//objects with invalid annotations, whose records are left as they are
+func (c *Controller) desiredSpecs() (map[string]recordSpec, map[string]bool) {
+	specs := map[string]recordSpec{}
+	invalid := map[string]bool{}
+	for prefix, indexer := range map[string]cache.Indexer{"service/": c.serviceIndexer, "ingress/": c.ingressIndexer} {
+		for _, obj := range indexer.List() {
+			accessor, err := meta.Accessor(obj)
+			if err != nil {
+				continue
+			}
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				continue
+			}
+			key = prefix + key
+			if !c.wantsRecords(key, accessor.GetAnnotations()) {
+				continue
+			}
+			spec, ok := c.recordSpec(key, obj)
+			if !ok {
+				invalid[key] = true
+				continue
+			}
+			specs[key] = spec
+		}
+	}
+	return specs, invalid
+}
+
+//plan - The changes that bring the records to the desired state, and the object each change is
+//made for. Names owned by another controller, or with records that weren't created by a
+//controller, are left alone and reported as conflicts.
+func (c *Controller) plan(records []DNSRecord) (Plan, map[DNSRecord]runtime.Object) {
+	specs, invalid := c.desiredSpecs()
+	plan := Plan{}
+	owners := map[DNSRecord]runtime.Object{}
+
+	//Index the registry records by the hostname they own, and the other records by type and name
+	registry := map[string][]registryRef{}
+	existing := map[string][]DNSRecord{}
+	for _, record := range records {
+		if record.RecordType != "TXT" {
+			existing[record.RecordType+" "+strings.ToLower(record.Name)] = append(existing[record.RecordType+" "+strings.ToLower(record.Name)], record)
+			continue
+		}
+		if entry, ok := parseRegistryContent(record.Content); ok {
+			hostname := strings.ToLower(c.hostnameFromRegistry(record.Name))
+			registry[hostname] = append(registry[hostname], registryRef{Record: record, Entry: entry})
+		}
+	}
+
+	//The keys that want each hostname, in key order so the plan doesn't depend on the informers
+	keys := []string{}
+	for key := range specs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	wanted := map[string][]string{}
+	hostnames := []string{}
+	for _, key := range keys {
+		for _, hostname := range specs[key].Hostnames {
+			if _, ok := wanted[hostname]; !ok {
+				hostnames = append(hostnames, hostname)
+			}
+			wanted[hostname] = append(wanted[hostname], key)
+		}
+	}
+	sort.Strings(hostnames)
+
+	for _, hostname := range hostnames {
+		winner, conflict := c.claim(hostname, wanted[hostname], registry[hostname], existing, specs)
+		if conflict != nil {
+			for _, key := range wanted[hostname] {
+				c.recorder.Eventf(specs[key].Object, v1.EventTypeWarning, "OwnershipConflict", "Not updating %v: %v", hostname, conflict)
+			}
+			continue
+		}
+		for _, key := range wanted[hostname] {
+			if key != winner {
+				conflict := &OwnershipConflictError{Name: hostname, Owner: winner, RecordType: "TXT"}
+				c.recorder.Eventf(specs[key].Object, v1.EventTypeWarning, "OwnershipConflict", "Not updating %v: %v", hostname, conflict)
+			}
+		}
+
+		//Changes the policy of the object doesn't allow are left out of the plan
+		spec := specs[winner]
+		add := func(changes *[]DNSRecord, record DNSRecord, allowed bool) {
+			if allowed {
+				*changes = append(*changes, record)
+				owners[record] = spec.Object
+			}
+		}
+		create := func(record DNSRecord) { add(&plan.Creates, record, true) }
+		update := func(record DNSRecord) { add(&plan.Updates, record, policyAllowsUpdate(spec.Policy)) }
+		remove := func(record DNSRecord) { add(&plan.Deletes, record, policyAllowsDelete(spec.Policy)) }
+
+		//The registry record at the configured name is kept, others are moved there
+		name := c.registryName(hostname)
+		content := registryContent(c.config.OwnerID, winner, spec.Family, spec.AnnotatedPolicy)
+		found := false
+		for _, ref := range registry[hostname] {
+			if found || !strings.EqualFold(ref.Record.Name, name) {
+				remove(ref.Record)
+				continue
+			}
+			found = true
+			if ref.Record.Content != content {
+				record := ref.Record
+				record.Content = content
+				update(record)
+			}
+		}
+		if !found && (len(registry[hostname]) == 0 || policyAllowsUpdate(spec.Policy)) {
+			create(DNSRecord{RecordType: "TXT", Name: name, Content: content, TTL: 1})
+		}
+
+		proxied := spec.Proxied && c.provider.Capabilities().SupportsProxying
+		for _, address := range c.addresses(spec.Family) {
+			current := existing[address.recordType+" "+hostname]
+			if !address.wanted || address.ip == "" {
+				if !publishes(registry[hostname], address.recordType) {
+					continue
+				}
+				for _, record := range current {
+					remove(record)
+				}
+				continue
+			}
+			record := DNSRecord{RecordType: address.recordType, Name: hostname, Content: address.ip, TTL: 1, Proxied: proxied}
+			if len(current) == 0 {
+				create(record)
+				continue
+			}
+			record.ID = current[0].ID
+			if current[0] != record {
+				update(record)
+			}
+		}
+	}
+
+	//Names nobody wants anymore are deleted, unless they are owned by another controller, are
+	//legacy records that may belong to another cluster, are owned by an object whose annotations
+	//can't be read, or the policy of the owner doesn't allow deletes
+	orphans := []string{}
+	for hostname := range registry {
+		if _, ok := wanted[hostname]; !ok {
+			orphans = append(orphans, hostname)
+		}
+	}
+	sort.Strings(orphans)
+	for _, hostname := range orphans {
+		keep := false
+		var object runtime.Object
+		for _, ref := range registry[hostname] {
+			if spec, ok := specs[ref.Entry.Resource]; ok {
+				object = spec.Object
+			}
+			policy, err := c.ownerPolicy(ref.Entry)
+			if !ref.Entry.ownedBy(c.config.OwnerID) || invalid[ref.Entry.Resource] || err != nil || !policyAllowsDelete(policy) {
+				keep = true
+			}
+		}
+		if keep {
+			continue
+		}
+		for _, recordType := range []string{"A", "AAAA"} {
+			if !publishes(registry[hostname], recordType) {
+				continue
+			}
+			for _, record := range existing[recordType+" "+hostname] {
+				plan.Deletes = append(plan.Deletes, record)
+				owners[record] = object
+			}
+		}
+		for _, ref := range registry[hostname] {
+			plan.Deletes = append(plan.Deletes, ref.Record)
+			owners[ref.Record] = object
+		}
+	}
+
+	return plan, owners
+}
+
+//publishes - Check if one of the registry records says the controller published records of the type
+func publishes(refs []registryRef, recordType string) bool {
+	for _, ref := range refs {
+		if ref.Entry.publishes(recordType) {
+			return true
+		}
+	}
+	return false
+}
+
+//claim - Pick the key that gets the hostname out of the keys that want it. The key already in
+//the registry record keeps the name, otherwise the first key gets it. A legacy record of
+//another key is only taken over if the key adopts the name. Returns an
+//*OwnershipConflictError if none of the keys can have the name.
+func (c *Controller) claim(hostname string, keys []string, refs []registryRef, existing map[string][]DNSRecord, specs map[string]recordSpec) (string, error) {
+	winner := keys[0]
+	for _, ref := range refs {
+		if !ref.Entry.Legacy && !ref.Entry.ownedBy(c.config.OwnerID) {
+			return "", &OwnershipConflictError{Name: hostname, Owner: ref.Entry.Owner, RecordType: "TXT"}
+		}
+		if containsString(keys, ref.Entry.Resource) {
+			winner = ref.Entry.Resource
+		}
+	}
+	for _, ref := range refs {
+		if ref.Entry.Legacy && ref.Entry.Resource != winner && !specs[winner].Adopt {
+			return "", &OwnershipConflictError{Name: hostname, Owner: ref.Entry.Resource, RecordType: "TXT"}
+		}
+	}
+	if len(refs) == 0 && !specs[winner].Adopt {
+		for _, recordType := range []string{"A", "AAAA", "CNAME"} {
+			if len(existing[recordType+" "+hostname]) > 0 {
+				return "", &OwnershipConflictError{Name: hostname, RecordType: recordType}
+			}
+		}
+	}
+	return winner, nil
+}
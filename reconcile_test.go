@@ -0,0 +1,306 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+//newTestReconcile - Controller in plan mode with a Service that wants web.example.com, a Service
+//that wants a name owned by another cluster, and the records of a deleted Service
+func newTestReconcile(t *testing.T) (*Controller, *record.FakeRecorder, *cloudflaretest.Server, []cloudflaretest.Record) {
+	cf, server := newTestCloudflare(t)
+	orphans := []cloudflaretest.Record{
+		server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "old.example.com", Content: "1.2.3.4"}),
+		server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "old.example.com", Content: "heritage=cf-ddns,owner=default,resource=service/default/old"}),
+	}
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "taken.example.com", Content: "heritage=cf-ddns,owner=other,resource=service/default/taken"})
+
+	controller, recorder := newTestController(cf, "1.2.3.4")
+	controller.config.ReconcileMode = ReconcilePlan
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+	controller.serviceIndexer.Add(newTestService("taken", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "taken.example.com",
+	}))
+	server.ResetRequests()
+	return controller, recorder, server, orphans
+}
+
+func TestReconcileAppliesBatch(t *testing.T) {
+	controller, recorder, server, _ := newTestReconcile(t)
+	defer server.Close()
+
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	want := []string{
+		"A web.example.com 1.2.3.4",
+		"TXT taken.example.com heritage=cf-ddns,owner=other,resource=service/default/taken",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reconcile = %v, want %v", got, want)
+	}
+	wantRequests := []string{"GET /zones/zone1/dns_records", "POST /zones/zone1/dns_records/batch"}
+	if got := server.Requests(); !reflect.DeepEqual(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+	wantEvents := []string{
+		"Warning OwnershipConflict Not updating taken.example.com: taken.example.com is owned by other",
+		"Normal RecordCreated Created TXT record web.example.com with heritage=cf-ddns,owner=default,resource=service/default/web",
+		"Normal RecordCreated Created A record web.example.com with 1.2.3.4",
+	}
+	if got := drainEvents(recorder); !reflect.DeepEqual(got, wantEvents) {
+		t.Errorf("events = %v, want %v", got, wantEvents)
+	}
+
+	//The records are as wanted, so the next reconcile only lists them
+	server.ResetRequests()
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, wantRequests[:1]) {
+		t.Errorf("requests of an unchanged reconcile = %v", got)
+	}
+}
+
+func TestReconcileWithoutBatch(t *testing.T) {
+	controller, _, server, orphans := newTestReconcile(t)
+	defer server.Close()
+	server.DisableBatch = true
+
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	want := []string{
+		"A web.example.com 1.2.3.4",
+		"TXT taken.example.com heritage=cf-ddns,owner=other,resource=service/default/taken",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reconcile = %v, want %v", got, want)
+	}
+
+	//TXT records are created before and deleted after the A records they own
+	wantRequests := []string{
+		"GET /zones/zone1/dns_records",
+		"POST /zones/zone1/dns_records/batch",
+		"POST /zones/zone1/dns_records",
+		"POST /zones/zone1/dns_records",
+		"DELETE /zones/zone1/dns_records/" + orphans[0].ID,
+		"DELETE /zones/zone1/dns_records/" + orphans[1].ID,
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+	records := server.Records("")
+	if created := records[len(records)-2:]; created[0].RecordType != "TXT" || created[1].RecordType != "A" {
+		t.Errorf("records created in the order %v", cloudflaretest.RecordStrings(created))
+	}
+}
+
+func TestReconcileClaims(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "shared.example.com", Content: "service/default/b"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "manual.example.com", Content: "9.9.9.9"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "legacy.example.com", Content: "service/prod/web"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "legacy.example.com", Content: "9.9.9.9"})
+	controller, recorder := newTestController(cf, "1.2.3.4")
+	for _, name := range []string{"a", "b"} {
+		controller.serviceIndexer.Add(newTestService(name, map[string]string{
+			"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "shared.example.com,manual.example.com",
+		}))
+	}
+	controller.serviceIndexer.Add(newTestService("c", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "legacy.example.com",
+	}))
+
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+
+	//The legacy record of b is upgraded, since b already owns the name. The legacy record of
+	//another key may belong to another cluster, so c doesn't take it over and it isn't deleted.
+	want := []string{
+		"A legacy.example.com 9.9.9.9",
+		"A manual.example.com 9.9.9.9",
+		"A shared.example.com 1.2.3.4",
+		"TXT legacy.example.com service/prod/web",
+		"TXT shared.example.com heritage=cf-ddns,owner=default,resource=service/default/b",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reconcile = %v, want %v", got, want)
+	}
+	wantEvents := []string{
+		"Warning OwnershipConflict Not updating legacy.example.com: legacy.example.com is owned by service/prod/web",
+		"Warning OwnershipConflict Not updating manual.example.com: manual.example.com has a A record that is not managed by the controller, set the adopt annotation to take it over",
+		"Warning OwnershipConflict Not updating manual.example.com: manual.example.com has a A record that is not managed by the controller, set the adopt annotation to take it over",
+		"Warning OwnershipConflict Not updating shared.example.com: shared.example.com is owned by service/default/b",
+		"Normal RecordCreated Created A record shared.example.com with 1.2.3.4",
+		"Normal RecordUpdated Updated TXT record shared.example.com to heritage=cf-ddns,owner=default,resource=service/default/b",
+	}
+	if got := drainEvents(recorder); !reflect.DeepEqual(got, wantEvents) {
+		t.Errorf("events = %v, want %v", got, wantEvents)
+	}
+}
+
+func TestApplyPlanRejectedBatch(t *testing.T) {
+	controller, _, server, orphans := newTestReconcile(t)
+	defer server.Close()
+	records, err := controller.provider.ListRecords(RecordFilter{})
+	if err != nil {
+		t.Fatalf("ListRecords() error = %v", err)
+	}
+	plan, _ := controller.plan(records)
+	server.ResetRequests()
+	server.FailNext(400, 1004, "DNS Validation Error")
+
+	//The rejected batch is applied one record at a time
+	applied, err := applyPlan(controller.provider, plan, controller.recordHostname)
+	if err != nil {
+		t.Fatalf("applyPlan() error = %v", err)
+	}
+	if len(applied.Creates) != 2 || len(applied.Deletes) != 2 {
+		t.Errorf("applyPlan() applied = %v, want every change of %v", applied, plan)
+	}
+	want := []string{
+		"A web.example.com 1.2.3.4",
+		"TXT taken.example.com heritage=cf-ddns,owner=other,resource=service/default/taken",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after applyPlan = %v, want %v", got, want)
+	}
+	wantRequests := []string{
+		"POST /zones/zone1/dns_records/batch",
+		"POST /zones/zone1/dns_records",
+		"POST /zones/zone1/dns_records",
+		"DELETE /zones/zone1/dns_records/" + orphans[0].ID,
+		"DELETE /zones/zone1/dns_records/" + orphans[1].ID,
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+}
+
+func TestApplyPlanRejectedBatchOfOneZone(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddZone("zone2", "example.org")
+	if err := cf.LoadZones(); err != nil {
+		t.Fatalf("LoadZones() error = %v", err)
+	}
+	old := server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "old.example.com", Content: "1.2.3.4"})
+	plan := Plan{
+		Creates: []DNSRecord{
+			{RecordType: "A", Name: "a.example.com", Content: "1.2.3.4", TTL: 1},
+			{RecordType: "A", Name: "b.example.org", Content: "1.2.3.4", TTL: 1},
+		},
+		Deletes: []DNSRecord{
+			{ID: old.ID, RecordType: "A", Name: "old.example.com"},
+			{ID: "missing", RecordType: "A", Name: "gone.example.org"},
+		},
+	}
+	server.ResetRequests()
+
+	//The batch of example.com is applied, only the changes of example.org are made one at a time
+	applied, err := applyPlan(cf, plan, func(record DNSRecord) string { return record.Name })
+	if err == nil {
+		t.Error("applyPlan() error = nil, want the error of the missing record")
+	}
+	want := []string{"A a.example.com 1.2.3.4", "A b.example.org 1.2.3.4"}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after applyPlan = %v, want %v", got, want)
+	}
+	wantRequests := []string{
+		"POST /zones/zone1/dns_records/batch",
+		"POST /zones/zone2/dns_records/batch",
+		"POST /zones/zone2/dns_records",
+		"DELETE /zones/zone2/dns_records/missing",
+	}
+	if got := server.Requests(); !reflect.DeepEqual(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+	if len(applied.Creates) != 2 || len(applied.Deletes) != 1 {
+		t.Errorf("applyPlan() applied = %+v, want both creates and the delete of old.example.com", applied)
+	}
+}
+
+func TestApplyPlanSkipsFailedHostnames(t *testing.T) {
+	provider := NewMemoryProvider([]string{"example.com"})
+	missing := DNSRecord{ID: "missing", RecordType: "A", Name: "gone.example.com", Content: "1.2.3.4"}
+	plan := Plan{
+		Creates: []DNSRecord{
+			{RecordType: "A", Name: "web.example.com", Content: "1.2.3.4"},
+			{RecordType: "TXT", Name: "web.example.com", Content: "service/default/web"},
+			{RecordType: "A", Name: "bad.example.org", Content: "1.2.3.4"},
+			{RecordType: "TXT", Name: "bad.example.org", Content: "service/default/bad"},
+		},
+		Deletes: []DNSRecord{
+			{RecordType: "TXT", Name: "gone.example.com", Content: "service/default/gone"},
+			missing,
+		},
+	}
+
+	//The A record of bad.example.org isn't created without its TXT record, and the TXT record of
+	//gone.example.com isn't deleted while its A record is left
+	applied, err := applyPlan(provider, plan, func(record DNSRecord) string { return record.Name })
+	if err == nil {
+		t.Fatal("applyPlan() error = nil, want the errors of the failed records")
+	}
+	want := Plan{Creates: []DNSRecord{plan.Creates[1], plan.Creates[0]}}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("applyPlan() applied = %v, want %v", applied, want)
+	}
+}
+
+func TestPlanQueue(t *testing.T) {
+	queue := planQueue{workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())}
+	defer queue.ShutDown()
+	queue.Add("service/default/web")
+	queue.Add("ingress/default/web")
+	queue.AddRateLimited("service/default/api")
+
+	if got := queue.Len(); got != 1 {
+		t.Fatalf("queue length = %d, want 1", got)
+	}
+	if key, _ := queue.Get(); key != reconcileKey {
+		t.Errorf("queue key = %v, want %v", key, reconcileKey)
+	}
+}
+
+func TestReconcileKeepsUnpublishedFamilies(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "web.example.com", Content: "service/default/web"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "web.example.com", Content: "5.6.7.8"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "AAAA", Name: "web.example.com", Content: "2001:db8::1"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "old.example.com", Content: "heritage=cf-ddns,owner=default,resource=service/default/old"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "A", Name: "old.example.com", Content: "5.6.7.8"})
+	server.AddRecord("zone1", cloudflaretest.Record{RecordType: "AAAA", Name: "old.example.com", Content: "2001:db8::1"})
+	controller, _ := newTestController(cf, "1.2.3.4")
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "web.example.com",
+	}))
+
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+
+	//The AAAA records next to the A records of ipv4 objects were added by hand
+	want := []string{
+		"A web.example.com 1.2.3.4",
+		"AAAA old.example.com 2001:db8::1",
+		"AAAA web.example.com 2001:db8::1",
+		"TXT web.example.com heritage=cf-ddns,owner=default,resource=service/default/web",
+	}
+	if got := cloudflaretest.RecordStrings(server.Records("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reconcile = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//The TXT registry records which cluster and object own a name. The content looks like
+//heritage=cf-ddns,owner=prod,resource=service/namespace/name, followed by family=ipv6 or
+//family=dual if the object publishes AAAA records, so only records the controller published
+//are deleted, and by policy=upsert-only if the object has a policy annotation, so the policy
+//still applies once the object is deleted. Older versions stored only the resource key, those
+//records are upgraded by the sync of an object with that key, or taken over by an object
+//that adopts the name.
+//
+//The TXT record is at the name itself unless a prefix or suffix is configured, e.g. the
+//prefix "_cfddns." puts the record of hello.example.com at _cfddns.hello.example.com so it
+//doesn't collide with other TXT records. Records at the name itself are still read and are
+//moved to the configured name.
+
+//DefaultOwnerID - Owner ID used when none is configured
+const DefaultOwnerID = "default"
+
+const registryHeritage = "cf-ddns"
+
+//registryWildcardLabel - Replaces the * of a wildcard in the name of its TXT record, since
+//the * must be the leftmost label
+const registryWildcardLabel = "_wildcard"
+
+//registryApexLabel - Added in front of the apex of a zone when the prefix or suffix would
+//change its first label, which would move the TXT record out of the zone
+const registryApexLabel = "_apex"
+
+//registryEntry - The parsed content of a TXT registry record
+type registryEntry struct {
+	Owner    string
+	Resource string
+	//Family is the ip-family annotation of the object, empty for ipv4
+	Family string
+	//Policy is the policy annotation of the object, empty if it had none
+	Policy string
+	//Legacy is set for records that only contain the resource key
+	Legacy bool
+}
+
+//validateOwnerID - The owner ID is stored in the comma separated TXT content
+func validateOwnerID(ownerID string) error {
+	if ownerID == "" || strings.ContainsAny(ownerID, ",= \"") {
+		return fmt.Errorf("owner ID %q must not be empty or contain commas, equal signs, spaces or quotes", ownerID)
+	}
+	return nil
+}
+
+//validateRegistryAffixes - The suffix is added to the first label so it can't contain a dot
+func validateRegistryAffixes(prefix, suffix string) error {
+	if strings.Contains(prefix, "*") || strings.ContainsAny(suffix, ".*") {
+		return fmt.Errorf("TXT prefix %q must not contain a wildcard and suffix %q must not contain dots or a wildcard", prefix, suffix)
+	}
+	return nil
+}
+
+//registryName - The name of the TXT registry record of a hostname
+func (c *Controller) registryName(hostname string) string {
+	if c.config.RegistryPrefix == "" && c.config.RegistrySuffix == "" {
+		return hostname
+	}
+	labels := strings.SplitN(hostname, ".", 2)
+	if labels[0] == "*" {
+		labels[0] = registryWildcardLabel
+	}
+	if (c.config.RegistrySuffix != "" || !strings.HasSuffix(c.config.RegistryPrefix, ".")) && c.isZoneApex(hostname) {
+		labels = []string{registryApexLabel, hostname}
+	}
+	labels[0] = c.config.RegistryPrefix + labels[0] + c.config.RegistrySuffix
+	return strings.Join(labels, ".")
+}
+
+//isZoneApex - Check the hostname is the name of a managed zone, which is the case when the
+//hostname is managed but the name without its first label isn't
+func (c *Controller) isZoneApex(hostname string) bool {
+	labels := strings.SplitN(hostname, ".", 2)
+	if len(labels) < 2 || c.provider.ManagesName(hostname) != nil {
+		return false
+	}
+	return c.provider.ManagesName(labels[1]) != nil
+}
+
+//hostnameFromRegistry - The hostname a TXT registry record belongs to, the reverse of
+//registryName. Names that don't have the prefix and suffix are records at the name itself.
+func (c *Controller) hostnameFromRegistry(name string) string {
+	prefix, suffix := c.config.RegistryPrefix, c.config.RegistrySuffix
+	if (prefix == "" && suffix == "") || !strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix)) {
+		return name
+	}
+	labels := strings.SplitN(name[len(prefix):], ".", 2)
+	if !strings.HasSuffix(strings.ToLower(labels[0]), strings.ToLower(suffix)) || len(labels[0]) == len(suffix) {
+		return name
+	}
+	labels[0] = labels[0][:len(labels[0])-len(suffix)]
+	if labels[0] == registryApexLabel && len(labels) == 2 {
+		return labels[1]
+	}
+	if labels[0] == registryWildcardLabel {
+		labels[0] = "*"
+	}
+	return strings.Join(labels, ".")
+}
+
+//registryContent - The TXT content for a resource key owned by the owner, with the address
+//family unless it is ipv4 and the policy annotation of the object unless it is empty
+func registryContent(ownerID, key, family, policy string) string {
+	content := "heritage=" + registryHeritage + ",owner=" + ownerID + ",resource=" + key
+	if family != "" && family != FamilyIPv4 {
+		content += ",family=" + family
+	}
+	if policy != "" {
+		content += ",policy=" + policy
+	}
+	return content
+}
+
+//isResourceKey - Check the value looks like a service/namespace/name or ingress/namespace/name key
+func isResourceKey(key string) bool {
+	splitKey := strings.Split(key, "/")
+	if len(splitKey) != 3 || splitKey[1] == "" || splitKey[2] == "" {
+		return false
+	}
+	return splitKey[0] == "service" || splitKey[0] == "ingress"
+}
+
+//parseRegistryContent - Parse the content of a TXT record, ok is false if it isn't a registry record
+func parseRegistryContent(content string) (entry registryEntry, ok bool) {
+	content = strings.Trim(content, "\"")
+	if isResourceKey(content) {
+		return registryEntry{Resource: content, Legacy: true}, true
+	}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(content, ",") {
+		splitField := strings.SplitN(field, "=", 2)
+		if len(splitField) != 2 {
+			return registryEntry{}, false
+		}
+		fields[splitField[0]] = splitField[1]
+	}
+	if fields["heritage"] != registryHeritage || fields["owner"] == "" || !isResourceKey(fields["resource"]) {
+		return registryEntry{}, false
+	}
+	return registryEntry{Owner: fields["owner"], Resource: fields["resource"], Family: fields["family"], Policy: fields["policy"]}, true
+}
+
+//publishes - Check if the controller published records of the type for the entry. Legacy
+//entries and entries without a family only had A records, and the zero entry has none.
+func (e registryEntry) publishes(recordType string) bool {
+	if e.Resource == "" {
+		return false
+	}
+	family := e.Family
+	if family == "" {
+		family = FamilyIPv4
+	}
+	switch recordType {
+	case "A":
+		return family == FamilyIPv4 || family == FamilyDual
+	case "AAAA":
+		return family == FamilyIPv6 || family == FamilyDual
+	}
+	return false
+}
+
+//OwnershipConflictError - Returned when a name has records the controller doesn't own
+type OwnershipConflictError struct {
+	Name string
+	//Owner is the owner ID of another controller, empty for records created outside of any controller
+	Owner      string
+	RecordType string
+}
+
+func (e *OwnershipConflictError) Error() string {
+	if e.Owner != "" {
+		return e.Name + " is owned by " + e.Owner
+	}
+	return e.Name + " has a " + e.RecordType + " record that is not managed by the controller, set the adopt annotation to take it over"
+}
+
+//ownedBy - Check if the entry belongs to the owner. Legacy entries belong to nobody, since the
+//controllers of every cluster wrote the same content, until the sync of an object with their
+//key upgrades them.
+func (e registryEntry) ownedBy(ownerID string) bool {
+	return !e.Legacy && e.Owner == ownerID
+}
+
+//registryRecord - Find the TXT registry record of a hostname, at the configured name or else at
+//the hostname itself. Other TXT records such as SPF are ignored.
+func (c *Controller) registryRecord(hostname string) (DNSRecord, registryEntry, error) {
+	names := []string{c.registryName(hostname)}
+	if names[0] != hostname {
+		names = append(names, hostname)
+	}
+	for _, name := range names {
+		records, err := c.provider.ListRecords(RecordFilter{RecordType: "TXT", Name: name})
+		if err != nil {
+			return DNSRecord{}, registryEntry{}, err
+		}
+		for _, record := range records {
+			if entry, ok := parseRegistryContent(record.Content); ok {
+				return record, entry, nil
+			}
+		}
+	}
+	return DNSRecord{}, registryEntry{}, nil
+}
+
+//ownedRecords - The TXT registry records of the key owned by this controller. Legacy records
+//aren't included, they may belong to an object with the same key in another cluster.
+func (c *Controller) ownedRecords(key string) ([]DNSRecord, error) {
+	records, err := c.provider.ListRecords(RecordFilter{RecordType: "TXT"})
+	if err != nil {
+		return nil, err
+	}
+	owned := []DNSRecord{}
+	for _, record := range records {
+		if entry, ok := parseRegistryContent(record.Content); ok && entry.ownedBy(c.config.OwnerID) && entry.Resource == key {
+			owned = append(owned, record)
+		}
+	}
+	return owned, nil
+}
+
+//registryPolicy - The sync policy for the records of an object that was deleted, the policy
+//stored in its TXT registry record or else the global policy
+func (c *Controller) registryPolicy(entry registryEntry) string {
+	if entry.Policy != "" {
+		return entry.Policy
+	}
+	return c.config.Policy
+}
+
+//syncRegistryRecord - Claim the name for the key, upgrading a legacy record of the key, and
+//return the entry the registry record had before, the zero entry if there was none. Returns
+//an *OwnershipConflictError if the name is owned by another controller or another key, or has a legacy record
+//of another key or records that weren't created by a controller and the spec doesn't adopt them. An existing record is only
+//changed if the policy of the spec allows updates, and only moved away from its old name if
+//it allows deletes.
+func (c *Controller) syncRegistryRecord(key, hostname string, spec recordSpec) (SyncResult, registryEntry, error) {
+	record, entry, err := c.registryRecord(hostname)
+	if err != nil {
+		return RecordUnchanged, entry, err
+	}
+	policy := spec.Policy
+	content := registryContent(c.config.OwnerID, key, spec.Family, spec.AnnotatedPolicy)
+	if record.ID == "" {
+		if !spec.Adopt {
+			for _, recordType := range []string{"A", "AAAA", "CNAME"} {
+				existing, err := c.provider.GetRecord(recordType, hostname)
+				if err != nil {
+					return RecordUnchanged, entry, err
+				}
+				if existing.ID != "" {
+					return RecordUnchanged, entry, &OwnershipConflictError{Name: hostname, RecordType: recordType}
+				}
+			}
+		}
+		_, err = c.provider.CreateRecord(DNSRecord{RecordType: "TXT", Name: c.registryName(hostname), Content: content, TTL: 1})
+		return RecordCreated, entry, err
+	}
+	//The object exists in this cluster, so a legacy record of its key is taken over. Legacy
+	//records of other keys may belong to an object in another cluster.
+	if entry.Legacy && entry.Resource != key && !spec.Adopt {
+		return RecordUnchanged, entry, &OwnershipConflictError{Name: hostname, Owner: entry.Resource, RecordType: "TXT"}
+	}
+	if !entry.Legacy && !entry.ownedBy(c.config.OwnerID) {
+		return RecordUnchanged, entry, &OwnershipConflictError{Name: hostname, Owner: entry.Owner, RecordType: "TXT"}
+	}
+	//Objects of this cluster that want the same name don't take it from each other
+	if !entry.Legacy && entry.Resource != key {
+		return RecordUnchanged, entry, &OwnershipConflictError{Name: hostname, Owner: entry.Resource, RecordType: "TXT"}
+	}
+	if !policyAllowsUpdate(policy) {
+		return RecordUnchanged, entry, nil
+	}
+	if !strings.EqualFold(record.Name, c.registryName(hostname)) {
+		fmt.Printf("Moving TXT record of %v for %v to %v\n", hostname, key, c.registryName(hostname))
+		_, err = c.provider.CreateRecord(DNSRecord{RecordType: "TXT", Name: c.registryName(hostname), Content: content, TTL: 1})
+		if err != nil || !policyAllowsDelete(policy) {
+			return RecordUpdated, entry, err
+		}
+		return RecordUpdated, entry, c.provider.DeleteRecord(record)
+	}
+	if record.Content != content {
+		if entry.Legacy {
+			fmt.Printf("Upgrading legacy TXT record of %v for %v\n", hostname, key)
+		}
+		record.Content = content
+		_, err = c.provider.UpdateRecord(record)
+		return RecordUpdated, entry, err
+	}
+	return RecordUnchanged, entry, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"testing"
+
+	"cloudflare_dynamic_dns_controller/cloudflaretest"
+)
+
+func TestParseRegistryContent(t *testing.T) {
+	tests := []struct {
+		content string
+		want    registryEntry
+		ok      bool
+	}{
+		{content: "heritage=cf-ddns,owner=prod,resource=service/default/web", want: registryEntry{Owner: "prod", Resource: "service/default/web"}, ok: true},
+		{content: "\"heritage=cf-ddns,owner=prod,resource=ingress/default/web\"", want: registryEntry{Owner: "prod", Resource: "ingress/default/web"}, ok: true},
+		{content: "heritage=cf-ddns,owner=prod,resource=service/default/web,policy=upsert-only", want: registryEntry{Owner: "prod", Resource: "service/default/web", Policy: "upsert-only"}, ok: true},
+		{content: "service/default/web", want: registryEntry{Resource: "service/default/web", Legacy: true}, ok: true},
+		{content: "heritage=external-dns,owner=prod,resource=service/default/web"},
+		{content: "heritage=cf-ddns,owner=prod,resource=pod/default/web"},
+		{content: "v=spf1 -all"},
+	}
+	for _, tt := range tests {
+		got, ok := parseRegistryContent(tt.content)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRegistryContent(%q) = %+v, %v, want %+v, %v", tt.content, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSyncRegistryRecordOwners(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	controller, _ := newTestController(provider, "1.2.3.4")
+	for _, record := range []DNSRecord{
+		{RecordType: "TXT", Name: "legacy.example.com", Content: "service/default/web"},
+		{RecordType: "TXT", Name: "other.example.com", Content: "service/prod/web"},
+		{RecordType: "A", Name: "other.example.com", Content: "5.6.7.8"},
+		{RecordType: "TXT", Name: "prod.example.com", Content: registryContent("prod", "service/default/web", "", "")},
+		{RecordType: "A", Name: "prod.example.com", Content: "5.6.7.8"},
+	} {
+		if _, err := provider.CreateRecord(record); err != nil {
+			t.Fatalf("CreateRecord() error = %v", err)
+		}
+	}
+
+	//Legacy records are upgraded in place
+	if _, _, err := controller.syncRegistryRecord("service/default/web", "legacy.example.com", recordSpec{Policy: PolicySync}); err != nil {
+		t.Fatalf("syncRegistryRecord() error = %v", err)
+	}
+	records, _ := provider.ListRecords(RecordFilter{Name: "legacy.example.com"})
+	if len(records) != 1 || records[0].Content != registryContent(DefaultOwnerID, "service/default/web", "", "") {
+		t.Errorf("legacy records = %+v", records)
+	}
+
+	//The name now belongs to service/default/web, so another object of the cluster can't take it
+	if _, _, err := controller.syncRegistryRecord("service/default/api", "legacy.example.com", recordSpec{Adopt: true, Policy: PolicySync}); err == nil {
+		t.Error("syncRegistryRecord() of a name owned by another key succeeded")
+	}
+	if record, _ := provider.GetRecord("TXT", "legacy.example.com"); record.Content != registryContent(DefaultOwnerID, "service/default/web", "", "") {
+		t.Errorf("TXT record owned by another key = %+v", record)
+	}
+
+	//Legacy records of another key may belong to another cluster, they are only taken over when adopting
+	if err := controller.cloudflareSyncRecordPair("service/default/other", "other.example.com", recordSpec{Family: FamilyIPv4, Policy: PolicySync}); err == nil {
+		t.Error("cloudflareSyncRecordPair() of a legacy record of another key succeeded")
+	}
+	if record, _ := provider.GetRecord("TXT", "other.example.com"); record.Content != "service/prod/web" {
+		t.Errorf("legacy record of another key = %+v", record)
+	}
+	if record, _ := provider.GetRecord("A", "other.example.com"); record.Content != "5.6.7.8" {
+		t.Errorf("A record of a legacy record of another key = %+v", record)
+	}
+	if _, _, err := controller.syncRegistryRecord("service/default/other", "other.example.com", recordSpec{Adopt: true, Policy: PolicySync}); err != nil {
+		t.Fatalf("syncRegistryRecord() adopting a legacy record error = %v", err)
+	}
+	if record, _ := provider.GetRecord("TXT", "other.example.com"); record.Content != registryContent(DefaultOwnerID, "service/default/other", "", "") {
+		t.Errorf("adopted legacy record = %+v", record)
+	}
+
+	//Records of another owner are left alone, even when adopting
+	if _, _, err := controller.syncRegistryRecord("service/default/web", "prod.example.com", recordSpec{Adopt: true, Policy: PolicySync}); err == nil {
+		t.Error("syncRegistryRecord() of another owner's name succeeded")
+	}
+	controller.cloudflareSyncRecordPair("service/default/web", "prod.example.com", recordSpec{Family: FamilyIPv4, Adopt: true, Policy: PolicySync})
+	controller.cloudflareDeleteRecordPair("service/default/web")
+	if record, _ := provider.GetRecord("A", "prod.example.com"); record.Content != "5.6.7.8" {
+		t.Errorf("A record of another owner = %+v", record)
+	}
+	if records, _ := provider.ListRecords(RecordFilter{Name: "legacy.example.com"}); len(records) != 0 {
+		t.Errorf("records left after delete = %+v", records)
+	}
+}
+
+func TestOwnedRecords(t *testing.T) {
+	cf, server := newTestCloudflare(t)
+	defer server.Close()
+	for _, content := range []string{
+		registryContent(DefaultOwnerID, "service/default/web", "", ""),
+		registryContent(DefaultOwnerID, "service/default/web", "", PolicyUpsertOnly),
+		registryContent(DefaultOwnerID, "service/default/api", "", ""),
+		registryContent("prod", "service/default/web", "", ""),
+		"service/default/web",
+	} {
+		server.AddRecord("zone1", cloudflaretest.Record{RecordType: "TXT", Name: "web.example.com", Content: content})
+	}
+	controller, _ := newTestController(cf, "1.2.3.4")
+	server.ResetRequests()
+
+	//The TXT records are listed once, whatever policy they store
+	records, err := controller.ownedRecords("service/default/web")
+	if err != nil {
+		t.Fatalf("ownedRecords() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("ownedRecords() = %+v, want the 2 records of this owner", records)
+	}
+	if got := server.Requests(); len(got) != 1 {
+		t.Errorf("requests = %v, want a single listing", got)
+	}
+}
+
+func TestRegistryName(t *testing.T) {
+	tests := []struct {
+		prefix, suffix string
+		hostname, name string
+	}{
+		{hostname: "hello.example.com", name: "hello.example.com"},
+		{prefix: "_cfddns.", hostname: "hello.example.com", name: "_cfddns.hello.example.com"},
+		{prefix: "_cfddns.", hostname: "*.apps.example.com", name: "_cfddns._wildcard.apps.example.com"},
+		{suffix: "-cfddns", hostname: "hello.example.com", name: "hello-cfddns.example.com"},
+		{prefix: "_cfddns.", hostname: "example.com", name: "_cfddns.example.com"},
+		{suffix: "-cfddns", hostname: "example.com", name: "_apex-cfddns.example.com"},
+		{prefix: "txt-", suffix: "-cfddns", hostname: "example.com", name: "txt-_apex-cfddns.example.com"},
+	}
+	for _, tt := range tests {
+		controller, _ := newTestController(NewMemoryProvider([]string{"example.com"}), "1.2.3.4")
+		controller.config.RegistryPrefix = tt.prefix
+		controller.config.RegistrySuffix = tt.suffix
+		if name := controller.registryName(tt.hostname); name != tt.name {
+			t.Errorf("registryName(%q) with %q, %q = %q, want %q", tt.hostname, tt.prefix, tt.suffix, name, tt.name)
+		}
+		if hostname := controller.hostnameFromRegistry(tt.name); hostname != tt.hostname {
+			t.Errorf("hostnameFromRegistry(%q) with %q, %q = %q, want %q", tt.name, tt.prefix, tt.suffix, hostname, tt.hostname)
+		}
+	}
+}
+
+func TestSyncRegistryRecordPrefix(t *testing.T) {
+	provider := NewMemoryProvider(nil)
+	controller, _ := newTestController(provider, "1.2.3.4")
+	controller.config.RegistryPrefix = "_cfddns."
+	for _, record := range []DNSRecord{
+		{RecordType: "TXT", Name: "web.example.com", Content: "v=spf1 -all"},
+		{RecordType: "TXT", Name: "web.example.com", Content: registryContent(DefaultOwnerID, "service/default/web", "", "")},
+		{RecordType: "A", Name: "web.example.com", Content: "1.2.3.4"},
+	} {
+		if _, err := provider.CreateRecord(record); err != nil {
+			t.Fatalf("CreateRecord() error = %v", err)
+		}
+	}
+
+	//The TXT record at the old name is moved and the SPF record is left alone
+	if _, _, err := controller.syncRegistryRecord("service/default/web", "web.example.com", recordSpec{Policy: PolicySync}); err != nil {
+		t.Fatalf("syncRegistryRecord() error = %v", err)
+	}
+	records, _ := provider.ListRecords(RecordFilter{RecordType: "TXT"})
+	if len(records) != 2 || records[0].Content != "v=spf1 -all" || records[1].Name != "_cfddns.web.example.com" {
+		t.Errorf("TXT records = %+v", records)
+	}
+
+	controller.cloudflareDeleteRecordPair("service/default/web")
+	records, _ = provider.ListRecords(RecordFilter{})
+	if len(records) != 1 || records[0].Content != "v=spf1 -all" {
+		t.Errorf("records after delete = %+v", records)
+	}
+}
+
+func TestCloudflareSyncZoneApexWithSuffix(t *testing.T) {
+	provider := NewMemoryProvider([]string{"example.com"})
+	controller, _ := newTestController(provider, "1.2.3.4")
+	controller.config.RegistrySuffix = "-owner"
+	controller.serviceIndexer.Add(newTestService("web", map[string]string{
+		"cloudflare-dynamic-dns.alpha.kubernetes.io/hostname": "example.com",
+	}))
+
+	//The TXT record of the apex stays in the zone
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if records, _ := provider.ListRecords(RecordFilter{RecordType: "TXT"}); len(records) != 1 || records[0].Name != "_apex-owner.example.com" {
+		t.Errorf("TXT records = %+v", records)
+	}
+
+	controller.serviceIndexer.Delete(newTestService("web", nil))
+	if err := controller.cloudflareSync("service/default/web"); err != nil {
+		t.Fatalf("cloudflareSync() error = %v", err)
+	}
+	if records, _ := provider.ListRecords(RecordFilter{}); len(records) != 0 {
+		t.Errorf("records after delete = %+v", records)
+	}
+}